@@ -1,11 +1,20 @@
 package commands
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/urfave/cli/v2"
 
 	shell "github.com/ipfs/go-ipfs-api"
 	logging "github.com/ipfs/go-log"
-	pinning "github.com/ipfs/go-pinning-service-http-client"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/config"
+	"github.com/coryschwartz/gateway-monitor/pkg/engine"
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
+	"github.com/coryschwartz/gateway-monitor/pkg/sink"
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
 )
 
 var (
@@ -13,6 +22,8 @@ var (
 	All = []*cli.Command{
 		singleCommand,
 		daemonCommand,
+		replayCommand,
+		pinningConformanceCommand,
 	}
 )
 
@@ -28,19 +39,86 @@ func GetIPFS(cctx *cli.Context) *shell.Shell {
 	return sh
 }
 
-func GetGW(cctx *cli.Context) string {
-	args := cctx.Args()
-	if len(args.Slice()) > 0 {
-		return args.First()
+// GetConfig loads the config file given with --config.
+// It returns nil if no config file was given.
+func GetConfig(cctx *cli.Context) (*config.Config, error) {
+	if !cctx.IsSet("config") {
+		return nil, nil
+	}
+	return config.Load(cctx.String("config"))
+}
+
+// GetGWs returns the gateways given as positional arguments,
+// then those from the config file, falling back to ipfs.io.
+// Gateways given as arguments are subdomain gateways with --subdomain.
+func GetGWs(cctx *cli.Context, cfg *config.Config) []gateway.Gateway {
+	if args := cctx.Args().Slice(); len(args) > 0 {
+		gws := make([]gateway.Gateway, 0, len(args))
+		for _, arg := range args {
+			gw := gateway.New(arg)
+			gw.Subdomain = cctx.Bool("subdomain")
+			gws = append(gws, gw)
+		}
+		return gws
 	}
-	return "https://ipfs.io"
+	if cfg != nil && len(cfg.Gateways) > 0 {
+		return config.Gateways(cfg.Gateways)
+	}
+	return []gateway.Gateway{gateway.New("https://ipfs.io")}
+}
+
+// GetTasks builds the tasks listed in the config file,
+// or returns the built-in tasks.All if it lists none, along with
+// tasks.Pinning if there are pinning services.
+func GetTasks(cfg *config.Config, pss []*provider.Provider) ([]task.Task, error) {
+	return newTaskSet().build(cfg, len(pss) > 0)
 }
 
-func GetPinningService(cctx *cli.Context) *pinning.Client {
+// SetupWorkers configures the engine's worker pool from --workers
+// and the config file. The flag takes precedence.
+func SetupWorkers(cctx *cli.Context, cfg *config.Config, eng *engine.Engine) {
+	workers := cctx.Int("workers")
+	var groups map[string]int
+	if cfg != nil {
+		if !cctx.IsSet("workers") && cfg.Workers > 0 {
+			workers = cfg.Workers
+		}
+		groups = cfg.Groups
+	}
+	eng.SetWorkers(workers)
+	eng.SetGroupLimits(groups)
+}
+
+// SetupSinks adds the given result sinks to the engine, plus a JSON
+// sink appending to the file given with --results, if any.
+func SetupSinks(cctx *cli.Context, eng *engine.Engine, sinks ...task.Sink) error {
+	for _, s := range sinks {
+		eng.AddSink(s)
+	}
+	if cctx.IsSet("results") {
+		f, err := os.OpenFile(cctx.String("results"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open results file: %w", err)
+		}
+		eng.AddSink(sink.NewJSON(f))
+	}
+	return nil
+}
+
+// GetPinningServices returns the pinning service given with
+// --pinning-service and --pinning-token, named "default", or those
+// from the config file.
+func GetPinningServices(cctx *cli.Context, cfg *config.Config) ([]*provider.Provider, error) {
 	if cctx.IsSet("pinning-service") && cctx.IsSet("pinning-token") {
 		url := cctx.String("pinning-service")
 		tok := cctx.String("pinning-token")
-		return pinning.NewClient(url, tok)
+		return []*provider.Provider{provider.New("default", url, tok)}, nil
 	}
-	return nil
+	if cctx.IsSet("pinning-service") {
+		log.Warn("--pinning-service is set without --pinning-token, not using it")
+	}
+	if cfg != nil {
+		return config.Providers(cfg.PinningServices)
+	}
+	return nil, nil
 }
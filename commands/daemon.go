@@ -8,7 +8,7 @@ import (
 	"github.com/urfave/cli/v2"
 
 	"github.com/coryschwartz/gateway-monitor/pkg/engine"
-	"github.com/coryschwartz/gateway-monitor/tasks"
+	"github.com/coryschwartz/gateway-monitor/pkg/sink"
 )
 
 var errCounter = prometheus.NewCounter(
@@ -23,13 +23,31 @@ func init() {
 }
 
 var daemonCommand = &cli.Command{
-	Name:  "daemon",
-	Usage: "run commands on schedule",
+	Name:      "daemon",
+	Usage:     "run commands on schedule",
+	ArgsUsage: "[gateway...]",
 	Action: func(cctx *cli.Context) error {
+		cfg, err := GetConfig(cctx)
+		if err != nil {
+			return err
+		}
+		pss, err := GetPinningServices(cctx, cfg)
+		if err != nil {
+			return err
+		}
+		set := newTaskSet()
+		tsks, err := set.build(cfg, len(pss) > 0)
+		if err != nil {
+			return err
+		}
 		ipfs := GetIPFS(cctx)
-		ps := GetPinningService(cctx)
-		gw := GetGW(cctx)
-		eng := engine.New(ipfs, ps, gw, tasks.All...)
+		gws := GetGWs(cctx, cfg)
+		eng := engine.New(ipfs, pss, gws, tsks...)
+		SetupWorkers(cctx, cfg, eng)
+		if err := SetupSinks(cctx, eng, sink.NewPrometheus(), sink.Log{}); err != nil {
+			return err
+		}
+		reloadOnSignal(cctx, eng, set)
 		go func() {
 			errCh := eng.Start(cctx.Context)
 			for {
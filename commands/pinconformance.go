@@ -0,0 +1,50 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/coryschwartz/gateway-monitor/tasks"
+)
+
+var pinningConformanceCommand = &cli.Command{
+	Name:  "pinning-conformance",
+	Usage: "check that the pinning services implement the Pinning Service API",
+	Action: func(cctx *cli.Context) error {
+		cfg, err := GetConfig(cctx)
+		if err != nil {
+			return err
+		}
+		pss, err := GetPinningServices(cctx, cfg)
+		if err != nil {
+			return err
+		}
+		if len(pss) == 0 {
+			return fmt.Errorf("no pinning service, set --pinning-service and --pinning-token or pinning_services in the config")
+		}
+		deviations := 0
+		for _, ps := range pss {
+			fmt.Printf("%s (%s)\n", ps.Name, ps.URL)
+			report, err := tasks.PinningConformance(cctx.Context, GetIPFS(cctx), ps.Client)
+			if err != nil {
+				return err
+			}
+			for _, check := range report.Checks {
+				result := "ok"
+				if len(check.Deviations) > 0 {
+					result = fmt.Sprintf("%d deviations", len(check.Deviations))
+				}
+				fmt.Printf("  %-14s %-8s %8dms  %s\n", check.Name, check.Endpoint, check.Duration.Milliseconds(), result)
+				for _, d := range check.Deviations {
+					fmt.Printf("      %s\n", d)
+				}
+			}
+			deviations += report.Deviations()
+		}
+		if deviations > 0 {
+			return fmt.Errorf("%d deviations from the pinning service API spec", deviations)
+		}
+		return nil
+	},
+}
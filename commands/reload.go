@@ -0,0 +1,125 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/config"
+	"github.com/coryschwartz/gateway-monitor/pkg/engine"
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
+	"github.com/coryschwartz/gateway-monitor/tasks"
+)
+
+// taskSet remembers which task was built for each config entry, so that
+// reloading the config keeps the existing task, and its metrics, for every
+// entry that didn't change. Entries that only changed their schedule are
+// kept as well and rescheduled.
+type taskSet struct {
+	built map[string]task.Task
+}
+
+func newTaskSet() *taskSet {
+	return &taskSet{
+		built: make(map[string]task.Task),
+	}
+}
+
+// build returns the tasks of the config, or the built-in tasks.All if it
+// lists none, along with tasks.Pinning if pinning is set. The set is only
+// updated if every task could be built.
+func (s *taskSet) build(cfg *config.Config, pinning bool) ([]task.Task, error) {
+	if cfg == nil || len(cfg.Tasks) == 0 {
+		if pinning {
+			return append(append([]task.Task{}, tasks.All...), tasks.Pinning...), nil
+		}
+		return tasks.All, nil
+	}
+	built := make(map[string]task.Task, len(cfg.Tasks))
+	tsks := make([]task.Task, 0, len(cfg.Tasks))
+	for i, tc := range cfg.Tasks {
+		key, err := taskKey(tc)
+		if err != nil {
+			return nil, fmt.Errorf("task %d: %w", i, err)
+		}
+		// identical entries are still separate tasks
+		for n := 1; built[key] != nil; n++ {
+			key = fmt.Sprintf("%s#%d", key, n)
+		}
+		t, ok := s.built[key]
+		switch {
+		case !ok:
+			t, err = tasks.Build(tc)
+			if err != nil {
+				return nil, fmt.Errorf("task %d: %w", i, err)
+			}
+		case t.Registration().Schedule != tc.Schedule:
+			t = task.WithSchedule(t, tc.Schedule)
+		}
+		built[key] = t
+		tsks = append(tsks, t)
+	}
+	if err := engine.Check(tsks...); err != nil {
+		return nil, err
+	}
+	s.built = built
+	return tsks, nil
+}
+
+// taskKey identifies a config entry, ignoring its schedule.
+func taskKey(tc config.Task) (string, error) {
+	tc.Schedule = ""
+	b, err := yaml.Marshal(tc)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// reloadOnSignal reloads the config file into the engine every time
+// the process receives SIGHUP.
+func reloadOnSignal(cctx *cli.Context, eng *engine.Engine, set *taskSet) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-sigCh:
+				if !cctx.IsSet("config") {
+					log.Warn("received SIGHUP, but there is no config file to reload")
+					continue
+				}
+				log.Info("received SIGHUP, reloading config")
+				if err := reload(cctx, eng, set); err != nil {
+					errCounter.Inc()
+					log.Errorw("failed to reload config, keeping the current tasks", "err", err)
+				}
+			case <-cctx.Context.Done():
+				signal.Stop(sigCh)
+				return
+			}
+		}
+	}()
+}
+
+func reload(cctx *cli.Context, eng *engine.Engine, set *taskSet) error {
+	cfg, err := GetConfig(cctx)
+	if err != nil {
+		return err
+	}
+	pss, err := GetPinningServices(cctx, cfg)
+	if err != nil {
+		return err
+	}
+	tsks, err := set.build(cfg, len(pss) > 0)
+	if err != nil {
+		return err
+	}
+	eng.Reload(GetGWs(cctx, cfg), pss, tsks...)
+	SetupWorkers(cctx, cfg, eng)
+	return nil
+}
@@ -0,0 +1,96 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/config"
+	"github.com/coryschwartz/gateway-monitor/pkg/fetch"
+	"github.com/coryschwartz/gateway-monitor/pkg/verify"
+	"github.com/coryschwartz/gateway-monitor/tasks"
+)
+
+var replayCommand = &cli.Command{
+	Name:  "replay",
+	Usage: "regenerate the payload of a benchmark from its logged seed",
+	Flags: []cli.Flag{
+		&cli.Int64Flag{
+			Name:     "seed",
+			Usage:    "seed of the payload, as logged by the benchmark",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "size",
+			Usage:    "size of the payload, e.g. 16MiB",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "shape",
+			Usage: "shape of the payload: file, many_files or deep_dir",
+			Value: string(tasks.ShapeFile),
+		},
+		&cli.StringFlag{
+			Name:  "out",
+			Usage: "write the payload to this path",
+		},
+		&cli.BoolFlag{
+			Name:  "add",
+			Usage: "add the payload to the local IPFS node and print its CID",
+		},
+		&cli.StringFlag{
+			Name:  "verify",
+			Usage: "fetch the payload from this URL (e.g. https://ipfs.io/ipfs/<cid>) and compare it with the regenerated content",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		size, err := config.ParseSize(cctx.String("size"))
+		if err != nil {
+			return err
+		}
+		shape, err := tasks.ParseShape(cctx.String("shape"))
+		if err != nil {
+			return err
+		}
+		payload := &tasks.Payload{
+			Seed:  cctx.Int64("seed"),
+			Size:  int(size),
+			Shape: shape,
+		}
+		if !cctx.IsSet("out") && !cctx.Bool("add") && !cctx.IsSet("verify") {
+			return fmt.Errorf("nothing to do: use --out, --add or --verify")
+		}
+
+		if cctx.IsSet("out") {
+			if err := payload.WriteTo(cctx.String("out")); err != nil {
+				return fmt.Errorf("failed to write payload: %w", err)
+			}
+			fmt.Printf("wrote payload to %s\n", cctx.String("out"))
+		}
+		if cctx.Bool("add") {
+			cid, err := payload.Add(cctx.Context, GetIPFS(cctx))
+			if err != nil {
+				return fmt.Errorf("failed to add payload to IPFS: %w", err)
+			}
+			fmt.Println(cid)
+		}
+		if cctx.IsSet("verify") {
+			for _, f := range payload.Files() {
+				url := cctx.String("verify")
+				if f.Path != "" {
+					url += "/" + f.Path
+				}
+				v := verify.NewReaderVerifier(f.Reader(), int64(f.Size))
+				fr, err := fetch.Get(cctx.Context, url, v)
+				if err != nil {
+					return err
+				}
+				if err := v.Verify(); err != nil {
+					return fmt.Errorf("%s (status %d): %w", url, fr.StatusCode, err)
+				}
+				fmt.Printf("%s: ok\n", url)
+			}
+		}
+		return nil
+	},
+}
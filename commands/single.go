@@ -8,22 +8,38 @@ import (
 	logging "github.com/ipfs/go-log"
 
 	"github.com/coryschwartz/gateway-monitor/pkg/engine"
-	"github.com/coryschwartz/gateway-monitor/tasks"
+	"github.com/coryschwartz/gateway-monitor/pkg/sink"
 )
 
 var singleCommand = &cli.Command{
-	Name:  "single",
-	Usage: "run tests once, ignoring the schedule",
+	Name:      "single",
+	Usage:     "run tests once, ignoring the schedule",
+	ArgsUsage: "[gateway...]",
 	Action: func(cctx *cli.Context) error {
 		// If we arent explicitly setting the log level,
 		// lets set it so most messages can be seen
 		if _, found := os.LookupEnv("GOLOG_LOG_LEVEL"); !found {
 			logging.SetAllLoggers(logging.LevelInfo)
 		}
+		cfg, err := GetConfig(cctx)
+		if err != nil {
+			return err
+		}
+		pss, err := GetPinningServices(cctx, cfg)
+		if err != nil {
+			return err
+		}
+		tsks, err := GetTasks(cfg, pss)
+		if err != nil {
+			return err
+		}
 		ipfs := GetIPFS(cctx)
-		ps := GetPinningService(cctx)
-		gw := GetGW(cctx)
-		eng := engine.NewSingle(ipfs, ps, gw, tasks.All...)
+		gws := GetGWs(cctx, cfg)
+		eng := engine.NewSingle(ipfs, pss, gws, tsks...)
+		SetupWorkers(cctx, cfg, eng)
+		if err := SetupSinks(cctx, eng, sink.Log{}); err != nil {
+			return err
+		}
 		return <-eng.Start(cctx.Context)
 	},
 }
@@ -15,6 +15,13 @@ func main() {
 		Usage:    "monitor IPFS gateway performance",
 		Commands: commands.All,
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "config",
+				Usage: "YAML file listing the tasks to run (uses the built-in tasks if unset)",
+				EnvVars: []string{
+					"GATEWAY_MONITOR_CONFIG",
+				},
+			},
 			&cli.StringFlag{
 				Name:  "ipfs",
 				Usage: "IPFS api URL (will use IPFS_PATH discovery if unset)",
@@ -22,6 +29,28 @@ func main() {
 					"GATEWAY_MONITOR_IPFS",
 				},
 			},
+			&cli.BoolFlag{
+				Name:  "subdomain",
+				Usage: "the gateways given as arguments are subdomain gateways (https://<cid>.ipfs.<host>/)",
+				EnvVars: []string{
+					"GATEWAY_MONITOR_SUBDOMAIN",
+				},
+			},
+			&cli.IntFlag{
+				Name:  "workers",
+				Usage: "how many tasks may run at the same time",
+				Value: 1,
+				EnvVars: []string{
+					"GATEWAY_MONITOR_WORKERS",
+				},
+			},
+			&cli.StringFlag{
+				Name:  "results",
+				Usage: "append the result of every task run to this file as JSON lines",
+				EnvVars: []string{
+					"GATEWAY_MONITOR_RESULTS",
+				},
+			},
 			&cli.StringFlag{
 				Name: "pinning-service",
 				Aliases: []string{
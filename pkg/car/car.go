@@ -0,0 +1,214 @@
+// Package car reads CARv1 streams, as served by trustless gateways,
+// one block at a time.
+package car
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+)
+
+// maxSection bounds the size of a header or block section,
+// so a broken response can't make us allocate without limit.
+const maxSection = 32 << 20
+
+// Reader reads the blocks of a CARv1 stream.
+type Reader struct {
+	br      *bufio.Reader
+	Version uint64
+	Roots   []cid.Cid
+}
+
+// NewReader reads the CAR header from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	cr := &Reader{
+		br: bufio.NewReader(r),
+	}
+	hdr, err := cr.section()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to read CAR header: %w", err)
+	}
+	if err := cr.decodeHeader(hdr); err != nil {
+		return nil, fmt.Errorf("invalid CAR header: %w", err)
+	}
+	if cr.Version != 1 {
+		return nil, fmt.Errorf("unsupported CAR version %d", cr.Version)
+	}
+	return cr, nil
+}
+
+// Next returns the next block. It returns io.EOF after the last block.
+func (r *Reader) Next() (cid.Cid, []byte, error) {
+	sec, err := r.section()
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	n, c, err := cid.CidFromBytes(sec)
+	if err != nil {
+		return cid.Undef, nil, fmt.Errorf("invalid block CID: %w", err)
+	}
+	return c, sec[n:], nil
+}
+
+func (r *Reader) section() ([]byte, error) {
+	l, err := binary.ReadUvarint(r.br)
+	if err != nil {
+		return nil, err
+	}
+	if l == 0 || l > maxSection {
+		return nil, fmt.Errorf("invalid section length %d", l)
+	}
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(r.br, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// decodeHeader decodes the DAG-CBOR header {"roots": [CID...], "version": 1}.
+// Only the subset of CBOR the header uses is supported.
+func (r *Reader) decodeHeader(b []byte) error {
+	d := &decoder{b: b}
+	major, n, err := d.head()
+	if err != nil {
+		return err
+	}
+	if major != majorMap {
+		return errors.New("header is not a map")
+	}
+	for i := uint64(0); i < n; i++ {
+		key, err := d.text()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "version":
+			major, v, err := d.head()
+			if err != nil {
+				return err
+			}
+			if major != majorUint {
+				return errors.New("version is not an integer")
+			}
+			r.Version = v
+		case "roots":
+			major, l, err := d.head()
+			if err != nil {
+				return err
+			}
+			if major != majorArray {
+				return errors.New("roots is not a list")
+			}
+			for j := uint64(0); j < l; j++ {
+				c, err := d.cid()
+				if err != nil {
+					return err
+				}
+				r.Roots = append(r.Roots, c)
+			}
+		default:
+			return fmt.Errorf("unexpected header field %q", key)
+		}
+	}
+	return nil
+}
+
+const (
+	majorUint  = 0
+	majorBytes = 2
+	majorText  = 3
+	majorArray = 4
+	majorMap   = 5
+	majorTag   = 6
+	// DAG-CBOR links are tagged byte strings.
+	tagCID = 42
+)
+
+type decoder struct {
+	b   []byte
+	off int
+}
+
+// head reads the major type and argument of the next item.
+func (d *decoder) head() (byte, uint64, error) {
+	if d.off >= len(d.b) {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	ib := d.b[d.off]
+	d.off++
+	major, info := ib>>5, ib&0x1f
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, fmt.Errorf("unsupported CBOR item 0x%x", ib)
+	}
+	if d.off+size > len(d.b) {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	var v uint64
+	for _, b := range d.b[d.off : d.off+size] {
+		v = v<<8 | uint64(b)
+	}
+	d.off += size
+	return major, v, nil
+}
+
+func (d *decoder) bytes(major byte) ([]byte, error) {
+	m, l, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if m != major {
+		return nil, fmt.Errorf("expected CBOR major type %d, got %d", major, m)
+	}
+	if uint64(len(d.b)-d.off) < l {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := d.b[d.off : d.off+int(l)]
+	d.off += int(l)
+	return b, nil
+}
+
+func (d *decoder) text() (string, error) {
+	b, err := d.bytes(majorText)
+	return string(b), err
+}
+
+func (d *decoder) cid() (cid.Cid, error) {
+	major, tag, err := d.head()
+	if err != nil {
+		return cid.Undef, err
+	}
+	if major != majorTag || tag != tagCID {
+		return cid.Undef, errors.New("root is not a CID")
+	}
+	b, err := d.bytes(majorBytes)
+	if err != nil {
+		return cid.Undef, err
+	}
+	// links carry a leading zero byte, the identity multibase prefix
+	if len(b) == 0 || b[0] != 0 {
+		return cid.Undef, errors.New("invalid CID link")
+	}
+	return cid.Cast(b[1:])
+}
@@ -0,0 +1,179 @@
+package car
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// cbor helpers to write the header by hand.
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 1<<8:
+		return []byte{major<<5 | 24, byte(n)}
+	case n < 1<<16:
+		return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+	default:
+		b := []byte{major<<5 | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(b[1:], n)
+		return b
+	}
+}
+
+func cborText(s string) []byte {
+	return append(cborHead(majorText, uint64(len(s))), s...)
+}
+
+func cborLink(c cid.Cid) []byte {
+	b := append([]byte{0}, c.Bytes()...)
+	out := cborHead(majorTag, tagCID)
+	out = append(out, cborHead(majorBytes, uint64(len(b)))...)
+	return append(out, b...)
+}
+
+func header(roots ...cid.Cid) []byte {
+	h := cborHead(majorMap, 2)
+	h = append(h, cborText("roots")...)
+	h = append(h, cborHead(majorArray, uint64(len(roots)))...)
+	for _, r := range roots {
+		h = append(h, cborLink(r)...)
+	}
+	h = append(h, cborText("version")...)
+	return append(h, cborHead(majorUint, 1)...)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func uvarint(n uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutUvarint(b, n)]
+}
+
+func section(b []byte) []byte {
+	return append(uvarint(uint64(len(b))), b...)
+}
+
+func rawCID(t *testing.T, data []byte) cid.Cid {
+	t.Helper()
+	h, err := mh.Sum(data, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cid.NewCidV1(cid.Raw, h)
+}
+
+func TestReader(t *testing.T) {
+	a, b := []byte("block a"), []byte("block b")
+	ca, cb := rawCID(t, a), rawCID(t, b)
+	data := concat(
+		section(header(ca)),
+		section(concat(ca.Bytes(), a)),
+		section(concat(cb.Bytes(), b)),
+	)
+
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Version != 1 || len(r.Roots) != 1 || !r.Roots[0].Equals(ca) {
+		t.Fatalf("unexpected header: version %d, roots %v", r.Version, r.Roots)
+	}
+	for _, want := range []struct {
+		c    cid.Cid
+		data []byte
+	}{{ca, a}, {cb, b}} {
+		c, blk, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.Equals(want.c) || !bytes.Equal(blk, want.data) {
+			t.Fatalf("got block %s %q, want %s %q", c, blk, want.c, want.data)
+		}
+	}
+	if _, _, err := r.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF after the last block, got %v", err)
+	}
+}
+
+func TestNewReaderErrors(t *testing.T) {
+	root := rawCID(t, []byte("root"))
+	valid := header(root)
+	link := cborLink(root)
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"empty", nil, "unexpected EOF"},
+		{"truncated varint", []byte{0x80}, "unexpected EOF"},
+		{"zero length", section(nil), "invalid section length 0"},
+		{"oversized section", uvarint(maxSection + 1), "invalid section length"},
+		{"huge varint", uvarint(1 << 62), "invalid section length"},
+		{"truncated section", section(valid)[:len(valid)/2], "unexpected EOF"},
+		{"not a map", section(cborHead(majorArray, 0)), "header is not a map"},
+		{"truncated map", section(cborHead(majorMap, 2)), "unexpected EOF"},
+		{"unknown field", section(concat(cborHead(majorMap, 1), cborText("extra"), cborHead(majorUint, 1))), "unexpected header field"},
+		{"version not an integer", section(concat(cborHead(majorMap, 1), cborText("version"), cborText("1"))), "version is not an integer"},
+		{"unsupported version", section(concat(cborHead(majorMap, 1), cborText("version"), cborHead(majorUint, 2))), "unsupported CAR version 2"},
+		{"missing version", section(concat(cborHead(majorMap, 1), cborText("roots"), cborHead(majorArray, 1), link)), "unsupported CAR version 0"},
+		{"roots not a list", section(concat(cborHead(majorMap, 1), cborText("roots"), link)), "roots is not a list"},
+		{"root not a link", section(concat(cborHead(majorMap, 1), cborText("roots"), cborHead(majorArray, 1), cborText("root"))), "root is not a CID"},
+		{"link without prefix", section(concat(cborHead(majorMap, 1), cborText("roots"), cborHead(majorArray, 1), cborHead(majorTag, tagCID), cborHead(majorBytes, uint64(len(root.Bytes()))), root.Bytes())), "invalid CID link"},
+		{"invalid link", section(concat(cborHead(majorMap, 1), cborText("roots"), cborHead(majorArray, 1), cborHead(majorTag, tagCID), cborHead(majorBytes, 3), []byte{0, 1, 2})), "invalid CAR header"},
+		{"more roots than given", section(concat(cborHead(majorMap, 1), cborText("roots"), cborHead(majorArray, 1<<40), link)), "unexpected EOF"},
+		{"text longer than header", section(concat(cborHead(majorMap, 1), cborHead(majorText, 100), []byte("ver"))), "unexpected EOF"},
+		{"indefinite length", section([]byte{majorMap<<5 | 31}), "unsupported CBOR item"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewReader(bytes.NewReader(tc.data))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestNextErrors(t *testing.T) {
+	blk := []byte("block")
+	c := rawCID(t, blk)
+	hdr := section(header(c))
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"truncated varint", []byte{0xff}, "unexpected EOF"},
+		{"truncated block", section(concat(c.Bytes(), blk))[:10], "unexpected EOF"},
+		{"oversized block", uvarint(maxSection + 1), "invalid section length"},
+		{"invalid CID", section([]byte{0x01, 0x55, 0xff}), "invalid block CID"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(concat(hdr, tc.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = r.Next()
+			if err == nil || err == io.EOF {
+				t.Fatalf("expected an error, got %v", err)
+			}
+			if !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
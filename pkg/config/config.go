@@ -0,0 +1,234 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron"
+	"gopkg.in/yaml.v3"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
+)
+
+// Config is the on-disk description of what the monitor should run.
+//
+//	gateways:
+//	  - https://ipfs.io
+//	  - url: https://dweb.link
+//	    subdomain: true
+//	pinning_services:
+//	  - name: example
+//	    url: https://pinning.example.com/psa
+//	    token_env: EXAMPLE_PINNING_TOKEN
+//	tasks:
+//	  - type: random_local
+//	    schedule: "0 * * * *"
+//	    params:
+//	      size: 16MiB
+type Config struct {
+	Gateways []Gateway `yaml:"gateways"`
+	// PinningServices are the providers pinning tasks are run against.
+	PinningServices []PinningService `yaml:"pinning_services,omitempty"`
+	// Workers is how many tasks may run at once.
+	Workers int `yaml:"workers,omitempty"`
+	// Groups sets how many tasks of each concurrency group may run
+	// at once. Groups that aren't listed run one task at a time.
+	Groups map[string]int `yaml:"groups,omitempty"`
+	Tasks  []Task         `yaml:"tasks"`
+}
+
+// Task is a single task instance. Params are decoded by the builder
+// registered for Type (see tasks.Registry). Schedule is a standard cron
+// spec, "minute hour day-of-month month day-of-week", or a descriptor
+// such as "@hourly".
+type Task struct {
+	Type string `yaml:"type"`
+	// Name overrides the task's default name in logs and engine metrics.
+	Name     string    `yaml:"name,omitempty"`
+	Schedule string    `yaml:"schedule"`
+	Gateways []Gateway `yaml:"gateways,omitempty"`
+	Group    string    `yaml:"group,omitempty"`
+	// Timeout bounds each attempt, e.g. "15m".
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	Retries int           `yaml:"retries,omitempty"`
+	Backoff *Backoff      `yaml:"backoff,omitempty"`
+	Params  yaml.Node     `yaml:"params,omitempty"`
+}
+
+// Gateway is a gateway to monitor (see gateway.Gateway). Path gateways
+// can be given as just their URL.
+type Gateway struct {
+	URL       string `yaml:"url"`
+	Subdomain bool   `yaml:"subdomain,omitempty"`
+}
+
+func (g *Gateway) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*g = Gateway{URL: value.Value}
+		return nil
+	}
+	type plain Gateway
+	return value.Decode((*plain)(g))
+}
+
+// Gateways converts gateway entries of the config.
+func Gateways(gws []Gateway) []gateway.Gateway {
+	if len(gws) == 0 {
+		return nil
+	}
+	converted := make([]gateway.Gateway, 0, len(gws))
+	for _, g := range gws {
+		gw := gateway.New(g.URL)
+		gw.Subdomain = g.Subdomain
+		converted = append(converted, gw)
+	}
+	return converted
+}
+
+// PinningService is a remote pinning service. Its token is read from the
+// environment variable TokenEnv or from the file TokenFile, so that it
+// doesn't have to be in the config.
+type PinningService struct {
+	// Name is the provider label of the metrics of pinning tasks.
+	Name      string `yaml:"name"`
+	URL       string `yaml:"url"`
+	TokenEnv  string `yaml:"token_env,omitempty"`
+	TokenFile string `yaml:"token_file,omitempty"`
+}
+
+// Token reads the access token of the pinning service.
+func (p PinningService) Token() (string, error) {
+	if p.TokenEnv != "" {
+		tok, ok := os.LookupEnv(p.TokenEnv)
+		if !ok || tok == "" {
+			return "", fmt.Errorf("pinning service %s: %s is not set", p.Name, p.TokenEnv)
+		}
+		return tok, nil
+	}
+	b, err := os.ReadFile(p.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("pinning service %s: failed to read token: %w", p.Name, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// Providers converts the pinning service entries of the config,
+// reading their tokens.
+func Providers(pss []PinningService) ([]*provider.Provider, error) {
+	if len(pss) == 0 {
+		return nil, nil
+	}
+	converted := make([]*provider.Provider, 0, len(pss))
+	for _, p := range pss {
+		tok, err := p.Token()
+		if err != nil {
+			return nil, err
+		}
+		converted = append(converted, provider.New(p.Name, p.URL, tok))
+	}
+	return converted, nil
+}
+
+// Backoff is the wait between retries of a task (see task.Backoff).
+type Backoff struct {
+	Initial    time.Duration `yaml:"initial"`
+	Max        time.Duration `yaml:"max,omitempty"`
+	Multiplier float64       `yaml:"multiplier,omitempty"`
+}
+
+// DecodeParams decodes the task parameters into v.
+// A task with no params leaves v untouched.
+func (t *Task) DecodeParams(v interface{}) error {
+	if t.Params.Kind == 0 {
+		return nil
+	}
+	return t.Params.Decode(v)
+}
+
+// Load reads and parses the config file at path.
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	return Parse(b)
+}
+
+// Parse parses a YAML config.
+func Parse(b []byte) (*Config, error) {
+	var cfg Config
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	names := make(map[string]bool, len(cfg.PinningServices))
+	for i, p := range cfg.PinningServices {
+		switch {
+		case p.Name == "":
+			return nil, fmt.Errorf("pinning service %d: missing name", i)
+		case names[p.Name]:
+			return nil, fmt.Errorf("pinning service %d: duplicate name %q", i, p.Name)
+		case p.URL == "":
+			return nil, fmt.Errorf("pinning service %s: missing url", p.Name)
+		case (p.TokenEnv == "") == (p.TokenFile == ""):
+			return nil, fmt.Errorf("pinning service %s: exactly one of token_env and token_file must be set", p.Name)
+		}
+		names[p.Name] = true
+	}
+	for i, t := range cfg.Tasks {
+		if t.Type == "" {
+			return nil, fmt.Errorf("task %d: missing type", i)
+		}
+		if t.Schedule == "" {
+			return nil, fmt.Errorf("task %d (%s): missing schedule", i, t.Type)
+		}
+		if _, err := cron.ParseStandard(t.Schedule); err != nil {
+			return nil, fmt.Errorf("task %d (%s): invalid schedule: %w", i, t.Type, err)
+		}
+	}
+	return &cfg, nil
+}
+
+// Size is a number of bytes. In the config it can be given as a plain
+// integer or with a binary unit suffix, e.g. "16MiB".
+type Size int
+
+var sizeUnits = []struct {
+	suffix string
+	mult   int
+}{
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"B", 1},
+}
+
+func (s *Size) UnmarshalYAML(value *yaml.Node) error {
+	v, err := ParseSize(value.Value)
+	if err != nil {
+		return err
+	}
+	*s = v
+	return nil
+}
+
+// ParseSize parses a size such as "256MiB" or "1024".
+func ParseSize(orig string) (Size, error) {
+	str := strings.TrimSpace(orig)
+	mult := 1
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(str, u.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+	n, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", orig, err)
+	}
+	return Size(n * mult), nil
+}
@@ -2,63 +2,149 @@ package engine
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/robfig/cron"
 
 	shell "github.com/ipfs/go-ipfs-api"
-	pinning "github.com/ipfs/go-pinning-service-http-client"
+	logging "github.com/ipfs/go-log"
 
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
 	"github.com/coryschwartz/gateway-monitor/pkg/queue"
 	"github.com/coryschwartz/gateway-monitor/pkg/task"
 )
 
+var (
+	log = logging.Logger("engine")
+
+	workers_total = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "gatewaymonitor",
+			Subsystem: "engine",
+			Name:      "workers",
+		})
+	workers_busy = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "gatewaymonitor",
+			Subsystem: "engine",
+			Name:      "workers_busy",
+		})
+	retries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor",
+			Subsystem: "engine",
+			Name:      "retry_count",
+		},
+		[]string{"task", "gateway", "provider"},
+	)
+	giveups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor",
+			Subsystem: "engine",
+			Name:      "giveup_count",
+		},
+		[]string{"task", "gateway", "provider"},
+	)
+	skips = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor",
+			Subsystem: "engine",
+			Name:      "skip_count",
+		},
+		[]string{"task", "gateway", "provider"},
+	)
+	task_failures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Name:      "failures_total",
+		},
+		[]string{"task", "kind", "gateway", "provider"},
+	)
+	worker_wait_time = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor",
+			Subsystem: "engine",
+			Name:      "worker_wait_seconds",
+			Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+		},
+		[]string{"group"},
+	)
+)
+
+func init() {
+	prometheus.Register(workers_total)
+	prometheus.Register(workers_busy)
+	prometheus.Register(worker_wait_time)
+	prometheus.Register(retries)
+	prometheus.Register(giveups)
+	prometheus.Register(skips)
+	prometheus.Register(task_failures)
+}
+
 type Engine struct {
-	c    *cron.Cron
-	q    *queue.TaskQueue
-	sh   *shell.Shell
-	ps   *pinning.Client
-	gw   string
-	done chan bool
+	mu     sync.Mutex
+	c      *cron.Cron
+	q      *queue.TaskQueue
+	sh     *shell.Shell
+	pss    []*provider.Provider
+	gws    []gateway.Gateway
+	tsks   []task.Task
+	pool   *semaphore
+	limits map[string]int
+	groups map[string]*semaphore
+	// runs that are waiting for a worker, running or waiting to retry
+	inflight map[runKey]bool
+	sinks    []task.Sink
+	done     chan bool
 }
 
-// Create an engine with Cron and Prometheus setup
-func New(sh *shell.Shell, ps *pinning.Client, gw string, tsks ...task.Task) *Engine {
+// Create an engine with Cron and Prometheus setup.
+// Every task is run against each of the gateways in gws, and pinning
+// tasks against each of the pinning services in pss as well.
+func New(sh *shell.Shell, pss []*provider.Provider, gws []gateway.Gateway, tsks ...task.Task) *Engine {
 	q := queue.NewTaskQueue()
-	return NewWithQueue(q, sh, ps, gw, tsks...)
+	return NewWithQueue(q, sh, pss, gws, tsks...)
 }
 
-func NewWithQueue(q *queue.TaskQueue, sh *shell.Shell, ps *pinning.Client, gw string, tsks ...task.Task) *Engine {
+func NewWithQueue(q *queue.TaskQueue, sh *shell.Shell, pss []*provider.Provider, gws []gateway.Gateway, tsks ...task.Task) *Engine {
 	eng := Engine{
-		c:    cron.New(),
-		q:    queue.NewTaskQueue(),
-		sh:   sh,
-		ps:   ps,
-		gw:   gw,
-		done: make(chan bool),
+		q:        q,
+		sh:       sh,
+		pss:      pss,
+		gws:      gws,
+		tsks:     tsks,
+		pool:     newSemaphore(1),
+		limits:   make(map[string]int),
+		groups:   make(map[string]*semaphore),
+		inflight: make(map[runKey]bool),
+		done:     make(chan bool),
 	}
 
 	for _, t := range tsks {
-		reg := t.Registration()
-		eng.c.AddFunc(reg.Schedule, scheduleClosure(eng.q, t))
-		for _, col := range reg.Collectors {
-			prometheus.Register(col)
-		}
+		register(t)
 	}
+	eng.c = newCron(q, tsks)
 	eng.c.Start()
 	return &eng
 }
 
 // Create an engine without Cron and prometheus.
-func NewSingle(sh *shell.Shell, ps *pinning.Client, gw string, tsks ...task.Task) *Engine {
+func NewSingle(sh *shell.Shell, pss []*provider.Provider, gws []gateway.Gateway, tsks ...task.Task) *Engine {
 	eng := Engine{
-		c:    cron.New(),
-		q:    queue.NewTaskQueue(),
-		sh:   sh,
-		ps:   ps,
-		gw:   gw,
-		done: make(chan bool, 1),
+		c:        cron.New(),
+		q:        queue.NewTaskQueue(),
+		sh:       sh,
+		pss:      pss,
+		gws:      gws,
+		pool:     newSemaphore(1),
+		limits:   make(map[string]int),
+		groups:   make(map[string]*semaphore),
+		inflight: make(map[runKey]bool),
+		done:     make(chan bool, 1),
 	}
 
 	for _, t := range tsks {
@@ -71,21 +157,76 @@ func NewSingle(sh *shell.Shell, ps *pinning.Client, gw string, tsks ...task.Task
 	return &eng
 }
 
+// SetWorkers sets how many tasks may run at the same time. The default
+// is 1. Lowering it while tasks are running doesn't stop any of them.
+func (e *Engine) SetWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	e.pool.setLimit(n)
+	workers_total.Set(float64(n))
+}
+
+// AddSink adds a sink that receives the result of every task run.
+// It must be called before Start.
+func (e *Engine) AddSink(s task.Sink) {
+	e.sinks = append(e.sinks, s)
+}
+
+// SetGroupLimits sets how many tasks of each concurrency group (see
+// task.Registration) may run at the same time, replacing the previous
+// limits. Groups without a limit run one task at a time.
+func (e *Engine) SetGroupLimits(limits map[string]int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.limits = make(map[string]int, len(limits))
+	for group, n := range limits {
+		if n < 1 {
+			n = 1
+		}
+		e.limits[group] = n
+	}
+	for group, sem := range e.groups {
+		sem.setLimit(e.limit(group))
+	}
+}
+
 func (e *Engine) Start(ctx context.Context) chan error {
 	errCh := make(chan error)
 
 	go func() {
+		var wg sync.WaitGroup
 		defer close(errCh)
 		tch := e.q.Subscribe()
 		for {
 			select {
 			case t := <-tch:
-				c, cancel := context.WithTimeout(ctx, 10*time.Minute)
-				defer cancel()
-				if err := t.Run(c, e.sh, e.ps, e.gw); err != nil {
-					errCh <- err
+				// fan the task out to every gateway we are watching,
+				// unless it doesn't use one, and pinning tasks to every
+				// provider
+				pss := e.providers(t)
+				for _, gw := range e.gateways(t) {
+					for _, ps := range pss {
+						r := runKey{task: task.Name(t), gateway: gw.URL, provider: ps.String()}
+						if !e.begin(r) {
+							// a task is run at most once at a time against
+							// each gateway, so a slow one doesn't pile up
+							log.Warnw("task is still running, skipping it", "task", r.task, "gateway", gw, "provider", ps)
+							skips.WithLabelValues(r.task, r.gateway, r.provider).Inc()
+							continue
+						}
+						wg.Add(1)
+						go func(t task.Task, gw gateway.Gateway, ps *provider.Provider) {
+							defer wg.Done()
+							defer e.end(r)
+							if err := e.retry(ctx, t, gw, ps); err != nil {
+								errCh <- err
+							}
+						}(t, gw, ps)
+					}
 				}
 			case <-e.done:
+				wg.Wait()
 				return
 			}
 		}
@@ -94,10 +235,290 @@ func (e *Engine) Start(ctx context.Context) chan error {
 	return errCh
 }
 
+// runKey identifies the runs of a task against a gateway and provider.
+type runKey struct {
+	task, gateway, provider string
+}
+
+// begin marks r as in flight, unless it already is.
+func (e *Engine) begin(r runKey) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.inflight[r] {
+		return false
+	}
+	e.inflight[r] = true
+	return true
+}
+
+func (e *Engine) end(r runKey) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.inflight, r)
+}
+
+// retry dispatches the task until it succeeds or runs out of retries.
+// The worker is released while waiting to retry.
+func (e *Engine) retry(ctx context.Context, t task.Task, gw gateway.Gateway, ps *provider.Provider) error {
+	reg := t.Registration()
+	backoff := task.DefaultBackoff
+	if reg.Backoff != nil {
+		backoff = *reg.Backoff
+	}
+	name := task.Name(t)
+	for attempt := 0; ; attempt++ {
+		err := e.dispatch(ctx, t, gw, ps, attempt)
+		if err == nil {
+			return nil
+		}
+		if attempt >= reg.Retries {
+			// giving up is only news if the task was retried
+			if attempt > 0 {
+				giveups.WithLabelValues(name, gw.URL, ps.String()).Inc()
+			}
+			return err
+		}
+		delay := backoff.Delay(attempt)
+		log.Warnw("task failed, retrying", "task", name, "gateway", gw, "provider", ps, "attempt", attempt+1, "delay", delay, "err", err)
+		retries.WithLabelValues(name, gw.URL, ps.String()).Inc()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			if attempt > 0 {
+				giveups.WithLabelValues(name, gw.URL, ps.String()).Inc()
+			}
+			return err
+		}
+	}
+}
+
+// dispatch waits for a free slot in the task's group and in the worker
+// pool, then runs the task.
+func (e *Engine) dispatch(ctx context.Context, t task.Task, gw gateway.Gateway, ps *provider.Provider, attempt int) error {
+	start := time.Now()
+	group := t.Registration().Group
+	if group != "" {
+		sem := e.group(group)
+		sem.acquire()
+		defer sem.release()
+	}
+	e.pool.acquire()
+	defer e.pool.release()
+	worker_wait_time.WithLabelValues(group).Observe(time.Since(start).Seconds())
+
+	workers_busy.Inc()
+	defer workers_busy.Dec()
+	return e.run(ctx, t, gw, ps, attempt)
+}
+
+func (e *Engine) group(name string) *semaphore {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	sem, ok := e.groups[name]
+	if !ok {
+		sem = newSemaphore(e.limit(name))
+		e.groups[name] = sem
+	}
+	return sem
+}
+
+// limit is the limit of a group. e.mu must be held.
+func (e *Engine) limit(group string) int {
+	if n, ok := e.limits[group]; ok {
+		return n
+	}
+	return 1
+}
+
+// gateways returns the gateways to run the task against: its own if it
+// lists any, or all of them. Tasks that don't use a gateway run once.
+func (e *Engine) gateways(t task.Task) []gateway.Gateway {
+	reg := t.Registration()
+	if reg.NoGateway {
+		return []gateway.Gateway{{}}
+	}
+	if gws := reg.Gateways; len(gws) > 0 {
+		return gws
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.gws
+}
+
+// providers returns the pinning services to run the task against: all of
+// them for pinning tasks, and none otherwise. The task still runs once
+// without a provider if there isn't any.
+func (e *Engine) providers(t task.Task) []*provider.Provider {
+	if !t.Registration().Pinning {
+		return []*provider.Provider{nil}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.pss) == 0 {
+		return []*provider.Provider{nil}
+	}
+	return e.pss
+}
+
+// run runs a single attempt of the task and hands its result to the sinks.
+func (e *Engine) run(ctx context.Context, t task.Task, gw gateway.Gateway, ps *provider.Provider, attempt int) error {
+	timeout := t.Registration().Timeout
+	if timeout <= 0 {
+		timeout = task.DefaultTimeout
+	}
+	c, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	res, err := t.Run(c, e.sh, ps, gw)
+	kind := task.KindOf(err)
+	if err != nil {
+		task_failures.WithLabelValues(task.Name(t), string(kind), gw.URL, ps.String()).Inc()
+	}
+	if res == nil {
+		// nothing to report, e.g. the TerminalTask
+		return err
+	}
+	res.Task = task.Name(t)
+	res.Gateway = gw.URL
+	res.Provider = ps.String()
+	res.Attempt = attempt
+	res.Start = start
+	res.Duration = time.Since(start)
+	switch {
+	case err == nil:
+		res.Status = task.StatusPass
+	case res.Status == "":
+		res.Status = task.StatusError
+	}
+	if err != nil && res.Err == nil {
+		res.Err = err
+	}
+	res.Kind = kind
+	for _, s := range e.sinks {
+		s.Record(res)
+	}
+	return err
+}
+
 func (e *Engine) Stop() {
 	e.done <- true
 }
 
+// Reload replaces the gateways, the pinning services and the scheduled
+// tasks of a running engine.
+// Tasks that were already scheduled keep their collectors, so pass the same
+// task values for anything that hasn't changed, and a task.WithSchedule of
+// the old value for a task that was only rescheduled. Tasks that are no
+// longer present are dropped from the queue and their collectors are
+// unregistered.
+func (e *Engine) Reload(gws []gateway.Gateway, pss []*provider.Provider, tsks ...task.Task) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	keep := make(map[task.Task]bool, len(tsks))
+	for _, t := range tsks {
+		keep[t] = true
+	}
+	old := make(map[task.Task]bool, len(e.tsks))
+	removed := make(map[string]bool)
+	for _, t := range e.tsks {
+		old[t] = true
+		if !keep[t] {
+			e.q.Remove(t)
+			unregister(t)
+			removed[task.Name(t)] = true
+		}
+	}
+	for _, t := range tsks {
+		if !old[t] {
+			register(t)
+			if removed[task.Name(t)] {
+				log.Infow("rescheduling task", "task", task.Name(t), "schedule", t.Registration().Schedule)
+				delete(removed, task.Name(t))
+				continue
+			}
+			log.Infow("adding task", "task", task.Name(t))
+		}
+	}
+	for name := range removed {
+		log.Infow("removing task", "task", name)
+	}
+
+	// robfig/cron can't remove entries, so swap in a fresh scheduler.
+	c := newCron(e.q, tsks)
+	e.c.Stop()
+	c.Start()
+	e.c = c
+	e.gws = gws
+	e.pss = pss
+	e.tsks = tsks
+}
+
+// newCron schedules the tasks. Schedules are standard cron specs (minute,
+// hour, day of month, month and day of week) or descriptors such as
+// "@hourly"; cron.AddFunc would take seconds as the first field.
+func newCron(q *queue.TaskQueue, tsks []task.Task) *cron.Cron {
+	c := cron.New()
+	for _, t := range tsks {
+		reg := t.Registration()
+		sched, err := cron.ParseStandard(reg.Schedule)
+		if err != nil {
+			log.Errorw("failed to schedule task", "task", task.Name(t), "schedule", reg.Schedule, "err", err)
+			continue
+		}
+		c.Schedule(sched, cron.FuncJob(scheduleClosure(q, t)))
+	}
+	return c
+}
+
+// Check returns an error if the tasks can't be scheduled together. Every
+// task must have a name of its own, since the name labels its metrics.
+func Check(tsks ...task.Task) error {
+	r := prometheus.NewRegistry()
+	names := make(map[string]bool, len(tsks))
+	for _, t := range tsks {
+		name := task.Name(t)
+		if names[name] {
+			return fmt.Errorf("more than one task is named %s, set the name of the others", name)
+		}
+		names[name] = true
+		if err := registerWith(r, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// taskRegisterer adds a task label to the metrics of t, so that tasks of
+// the same type, whose metrics have the same names, can run side by side.
+func taskRegisterer(r prometheus.Registerer, t task.Task) prometheus.Registerer {
+	return prometheus.WrapRegistererWith(prometheus.Labels{"task": task.Name(t)}, r)
+}
+
+func registerWith(r prometheus.Registerer, t task.Task) error {
+	tr := taskRegisterer(r, t)
+	for _, col := range t.Registration().Collectors {
+		if err := tr.Register(col); err != nil {
+			return fmt.Errorf("failed to register the metrics of task %s: %w", task.Name(t), err)
+		}
+	}
+	return nil
+}
+
+func register(t task.Task) {
+	if err := registerWith(prometheus.DefaultRegisterer, t); err != nil {
+		log.Errorw("task metrics won't be exported", "task", task.Name(t), "err", err)
+	}
+}
+
+func unregister(t task.Task) {
+	tr := taskRegisterer(prometheus.DefaultRegisterer, t)
+	for _, col := range t.Registration().Collectors {
+		tr.Unregister(col)
+	}
+}
+
 func scheduleClosure(q *queue.TaskQueue, t task.Task) func() {
 	return func() {
 		q.Push(t)
@@ -0,0 +1,42 @@
+package engine
+
+import "sync"
+
+// semaphore limits how many tasks run at once. Unlike a buffered channel,
+// its limit can be changed while it is held: lowering it lets the tasks
+// that are running finish, and only holds back the next ones.
+type semaphore struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	held  int
+	limit int
+}
+
+func newSemaphore(limit int) *semaphore {
+	s := &semaphore{limit: limit}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *semaphore) acquire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.held >= s.limit {
+		s.cond.Wait()
+	}
+	s.held++
+}
+
+func (s *semaphore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.held--
+	s.cond.Broadcast()
+}
+
+func (s *semaphore) setLimit(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = n
+	s.cond.Broadcast()
+}
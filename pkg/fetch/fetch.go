@@ -0,0 +1,171 @@
+package fetch
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timings break down how long each phase of a request took.
+// Phases that didn't happen, such as DNS on a reused connection, are zero.
+type Timings struct {
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+	// TTFB is measured from the start of the request
+	// to the first byte of the response.
+	TTFB time.Duration
+	// Transfer is measured from the first byte of the response
+	// to the end of the body.
+	Transfer time.Duration
+	Total    time.Duration
+}
+
+// Response is what was observed while fetching from a gateway.
+type Response struct {
+	Timings
+	StatusCode int
+	Header     http.Header
+	// Size is the number of body bytes read.
+	Size int64
+	// Reused is true if the request went over an existing connection.
+	Reused bool
+}
+
+// BytesPerSecond is the body transfer speed.
+func (r *Response) BytesPerSecond() float64 {
+	if r.Transfer <= 0 {
+		return 0
+	}
+	return float64(r.Size) / r.Transfer.Seconds()
+}
+
+// Fetcher makes instrumented HTTP requests.
+type Fetcher struct {
+	Client *http.Client
+}
+
+// Default is a Fetcher using http.DefaultClient.
+var Default = &Fetcher{Client: http.DefaultClient}
+
+// NoRedirect is a Fetcher that returns redirect responses instead of
+// following them, for checking where a gateway redirects to.
+var NoRedirect = &Fetcher{
+	Client: &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	},
+}
+
+// Get fetches url with the Default fetcher. See Fetcher.Do.
+func Get(ctx context.Context, url string, w io.Writer) (*Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return Default.Do(req, w)
+}
+
+// Do sends the request and copies the response body to w, which may be
+// nil to discard it. The returned response holds whatever was measured,
+// even if the request failed part way through.
+func (f *Fetcher) Do(req *http.Request, w io.Writer) (*Response, error) {
+	var (
+		mu                         sync.Mutex
+		dnsStart, connStart, tlsSt time.Time
+		firstByte                  time.Time
+		resp                       = new(Response)
+	)
+	start := time.Now()
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			resp.DNS = time.Since(dnsStart)
+		},
+		ConnectStart: func(string, string) {
+			mu.Lock()
+			defer mu.Unlock()
+			// several addresses may be dialed in parallel,
+			// we measure from the first attempt.
+			if connStart.IsZero() {
+				connStart = time.Now()
+			}
+		},
+		ConnectDone: func(_, _ string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				resp.Connect = time.Since(connStart)
+			}
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsSt = time.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				resp.TLS = time.Since(tlsSt)
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			resp.Reused = info.Reused
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			firstByte = time.Now()
+			resp.TTFB = firstByte.Sub(start)
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	hresp, err := client.Do(req)
+	if err != nil {
+		mu.Lock()
+		defer mu.Unlock()
+		resp.Total = time.Since(start)
+		return resp, err
+	}
+	defer hresp.Body.Close()
+	resp.StatusCode = hresp.StatusCode
+	resp.Header = hresp.Header
+
+	if w == nil {
+		w = ioutil.Discard
+	}
+	n, err := io.Copy(w, hresp.Body)
+
+	mu.Lock()
+	defer mu.Unlock()
+	resp.Size = n
+	resp.Total = time.Since(start)
+	if !firstByte.IsZero() {
+		resp.Transfer = time.Since(firstByte)
+	}
+	if err != nil {
+		return resp, fmt.Errorf("failed to read response body: %w", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,138 @@
+// Package gateway describes the gateways being monitored and how content
+// is addressed on them.
+package gateway
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multibase"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// maxLabel is the longest a DNS label may be.
+const maxLabel = 63
+
+// Gateway is an HTTP gateway to IPFS.
+type Gateway struct {
+	// URL is the base URL of the gateway, e.g. https://ipfs.io.
+	URL string
+	// Subdomain gateways serve every CID and IPNS name from its own
+	// origin, e.g. https://<cid>.ipfs.dweb.link/, instead of under a path.
+	Subdomain bool
+}
+
+// New creates a path gateway.
+func New(u string) Gateway {
+	return Gateway{URL: strings.TrimSuffix(u, "/")}
+}
+
+// String is the base URL, which identifies the gateway in logs and metrics.
+func (g Gateway) String() string {
+	return g.URL
+}
+
+// Path returns the URL at which the gateway serves a content path such
+// as /ipfs/<cid>/file or /ipns/<name>?format=car. Paths that can't be
+// served from a subdomain are requested from the gateway's own origin,
+// where a subdomain gateway should redirect them.
+func (g Gateway) Path(p string) string {
+	if !g.Subdomain {
+		return g.URL + p
+	}
+	u, err := g.SubdomainURL(p)
+	if err != nil {
+		return g.URL + p
+	}
+	return u
+}
+
+// SubdomainURL returns the URL of a content path on the subdomain form of
+// the gateway, whether or not the gateway is a subdomain gateway. This is
+// where a subdomain gateway redirects path requests to.
+func (g Gateway) SubdomainURL(p string) (string, error) {
+	base, err := url.Parse(g.URL)
+	if err != nil {
+		return "", err
+	}
+	ns, root, rest, err := split(p)
+	if err != nil {
+		return "", err
+	}
+	var label string
+	switch ns {
+	case "ipfs":
+		label, err = CIDLabel(root)
+	case "ipns":
+		label, err = IPNSLabel(root)
+	}
+	if err != nil {
+		return "", err
+	}
+	if rest == "" || rest[0] != '/' {
+		rest = "/" + rest
+	}
+	return fmt.Sprintf("%s://%s.%s.%s%s", base.Scheme, label, ns, base.Host, rest), nil
+}
+
+// split splits /<ns>/<root><rest> into its parts.
+func split(p string) (ns, root, rest string, err error) {
+	for _, ns := range []string{"ipfs", "ipns"} {
+		prefix := "/" + ns + "/"
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		root = p[len(prefix):]
+		if i := strings.IndexAny(root, "/?"); i >= 0 {
+			root, rest = root[:i], root[i:]
+		}
+		return ns, root, rest, nil
+	}
+	return "", "", "", fmt.Errorf("not an /ipfs/ or /ipns/ path: %s", p)
+}
+
+// CIDLabel is the DNS label of a CID on a subdomain gateway: CIDv0 is
+// converted to CIDv1, which is base32 encoded.
+func CIDLabel(s string) (string, error) {
+	c, err := cid.Decode(s)
+	if err != nil {
+		return "", err
+	}
+	label := cid.NewCidV1(c.Type(), c.Hash()).String()
+	if len(label) > maxLabel {
+		// base36 is shorter
+		label, err = c.StringOfBase(multibase.Base36)
+		if err != nil {
+			return "", err
+		}
+		if len(label) > maxLabel {
+			return "", fmt.Errorf("CID is too long for a DNS label: %s", s)
+		}
+	}
+	return label, nil
+}
+
+// IPNSLabel is the DNS label of an IPNS name on a subdomain gateway.
+// Keys are encoded as base36 CIDv1 and DNSLink names are inlined with
+// DNSLabel.
+func IPNSLabel(name string) (string, error) {
+	if strings.Contains(name, ".") {
+		return DNSLabel(name), nil
+	}
+	var hash mh.Multihash
+	if c, err := cid.Decode(name); err == nil {
+		hash = c.Hash()
+	} else if hash, err = mh.FromB58String(name); err != nil {
+		return "", fmt.Errorf("not an IPNS key: %s", name)
+	}
+	return cid.NewCidV1(cid.Libp2pKey, hash).StringOfBase(multibase.Base36)
+}
+
+// DNSLabel inlines a domain name into a single DNS label, the way subdomain
+// gateways expect DNSLink names: "-" becomes "--" and "." becomes "-", so
+// en.wikipedia-on-ipfs.org is en-wikipedia--on--ipfs-org.
+func DNSLabel(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(name, "-", "--"), ".", "-")
+}
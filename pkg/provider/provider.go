@@ -0,0 +1,37 @@
+// Package provider describes the remote pinning services that pinning
+// tasks are run against.
+package provider
+
+import (
+	"strings"
+
+	pinning "github.com/ipfs/go-pinning-service-http-client"
+)
+
+// Provider is a remote pinning service implementing the Pinning Service
+// API, with the client to talk to it.
+type Provider struct {
+	// Name identifies the provider in logs and metrics.
+	Name string
+	URL  string
+	*pinning.Client
+}
+
+// New creates a provider authenticating with the bearer token tok.
+func New(name, url, tok string) *Provider {
+	url = strings.TrimSuffix(url, "/")
+	return &Provider{
+		Name:   name,
+		URL:    url,
+		Client: pinning.NewClient(url, tok),
+	}
+}
+
+// String is the name of the provider, or "" for no provider, so that it
+// can be used as a metric label by tasks that run without one.
+func (p *Provider) String() string {
+	if p == nil {
+		return ""
+	}
+	return p.Name
+}
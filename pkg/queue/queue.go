@@ -22,23 +22,32 @@ var (
 			Subsystem: "queue",
 			Name:      "fails",
 		})
+	queue_wait_time = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor",
+			Subsystem: "queue",
+			Name:      "wait_seconds",
+			Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+		})
 )
 
 func init() {
 	prometheus.Register(queue_len)
 	prometheus.Register(queue_fails)
+	prometheus.Register(queue_wait_time)
 }
 
 type TaskQueue struct {
-	mu      sync.Mutex
-	tasks   []task.Task
-	taskmap map[task.Task]bool
+	mu    sync.Mutex
+	tasks []task.Task
+	// when each queued task was pushed
+	taskmap map[task.Task]time.Time
 }
 
 func NewTaskQueue() *TaskQueue {
 	return &TaskQueue{
 		tasks:   []task.Task{},
-		taskmap: make(map[task.Task]bool),
+		taskmap: make(map[task.Task]time.Time),
 	}
 }
 
@@ -56,7 +65,7 @@ func (q *TaskQueue) Push(tsks ...task.Task) {
 			continue
 		}
 		q.tasks = append(q.tasks, newtsk)
-		q.taskmap[newtsk] = true
+		q.taskmap[newtsk] = time.Now()
 		queue_len.Inc()
 	}
 }
@@ -70,11 +79,30 @@ func (q *TaskQueue) Pop() (task.Task, bool) {
 	}
 	t := q.tasks[0]
 	q.tasks = q.tasks[1:]
+	queue_wait_time.Observe(time.Since(q.taskmap[t]).Seconds())
 	delete(q.taskmap, t)
 	queue_len.Dec()
 	return t, true
 }
 
+// Remove drops a task that is waiting in the queue.
+func (q *TaskQueue) Remove(t task.Task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, found := q.taskmap[t]; !found {
+		return
+	}
+	for i, qt := range q.tasks {
+		if qt == t {
+			q.tasks = append(q.tasks[:i], q.tasks[i+1:]...)
+			break
+		}
+	}
+	delete(q.taskmap, t)
+	queue_len.Dec()
+}
+
 func (q *TaskQueue) Subscribe() chan task.Task {
 	ch := make(chan task.Task)
 	go func() {
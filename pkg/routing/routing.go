@@ -0,0 +1,248 @@
+// Package routing is a client of the Delegated Routing HTTP API
+// (/routing/v1), as served by e.g. https://delegated-ipfs.dev.
+package routing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multibase"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// Media types of the responses.
+const (
+	JSON       = "application/json"
+	NDJSON     = "application/x-ndjson"
+	IPNSRecord = "application/vnd.ipfs.ipns-record"
+)
+
+// Kinds of records, the path segment after /routing/v1/.
+const (
+	Providers = "providers"
+	Peers     = "peers"
+	IPNS      = "ipns"
+)
+
+// SchemaPeer is the schema of peer records.
+const SchemaPeer = "peer"
+
+// maxIPNSRecord is the largest IPNS record the spec allows.
+const maxIPNSRecord = 10 << 10
+
+// Record is a provider or peer record.
+type Record struct {
+	Schema    string   `json:"Schema"`
+	ID        string   `json:"ID"`
+	Addrs     []string `json:"Addrs,omitempty"`
+	Protocols []string `json:"Protocols,omitempty"`
+}
+
+// Validate checks the record against the spec. Records of unknown schemas
+// are valid, clients are expected to skip them.
+func (r Record) Validate() error {
+	switch r.Schema {
+	case "":
+		return &SchemaError{Msg: "record without Schema"}
+	case SchemaPeer:
+	default:
+		return nil
+	}
+	if _, err := ParsePeerID(r.ID); err != nil {
+		return &SchemaError{Msg: fmt.Sprintf("peer record with invalid ID %q: %v", r.ID, err)}
+	}
+	for _, a := range r.Addrs {
+		if _, err := multiaddr.NewMultiaddr(a); err != nil {
+			return &SchemaError{Msg: fmt.Sprintf("peer record %s with invalid address %q: %v", r.ID, a, err)}
+		}
+	}
+	return nil
+}
+
+// StatusError is an unexpected HTTP status from the endpoint.
+type StatusError struct {
+	URL  string
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d from %s", e.Code, e.URL)
+}
+
+// SchemaError is a response that doesn't follow the spec.
+type SchemaError struct {
+	Msg string
+}
+
+func (e *SchemaError) Error() string {
+	return e.Msg
+}
+
+// Client queries a delegated routing endpoint.
+type Client struct {
+	// URL is the base URL of the endpoint, without /routing/v1.
+	URL    string
+	Client *http.Client
+}
+
+// New creates a client using http.DefaultClient.
+func New(url string) *Client {
+	return &Client{
+		URL:    strings.TrimSuffix(url, "/"),
+		Client: http.DefaultClient,
+	}
+}
+
+// FindProviders returns the provider records of a CID. Not finding any
+// is not an error.
+func (c *Client) FindProviders(ctx context.Context, cid string) ([]Record, error) {
+	return c.Records(ctx, Providers, cid, JSON)
+}
+
+// FindPeers returns the peer records of a peer ID.
+func (c *Client) FindPeers(ctx context.Context, id string) ([]Record, error) {
+	key, err := PeerCID(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.Records(ctx, Peers, key, JSON)
+}
+
+// Records queries /routing/v1/<kind>/<key> for providers or peers, as
+// JSON or NDJSON (the accept media type). Responses that don't follow the
+// spec are a *SchemaError, but the records are checked with Validate by
+// the caller. Not finding any is not an error.
+func (c *Client) Records(ctx context.Context, kind, key, accept string) ([]Record, error) {
+	resp, err := c.get(ctx, kind, key, accept)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, &StatusError{URL: resp.Request.URL.String(), Code: resp.StatusCode}
+	}
+
+	ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if ct != accept {
+		return nil, &SchemaError{Msg: fmt.Sprintf("Content-Type is %q, expected %s", resp.Header.Get("Content-Type"), accept)}
+	}
+	if accept == NDJSON {
+		return decodeNDJSON(resp.Body)
+	}
+
+	field := "Providers"
+	if kind == Peers {
+		field = "Peers"
+	}
+	var out map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, &SchemaError{Msg: fmt.Sprintf("invalid JSON: %v", err)}
+	}
+	raw, ok := out[field]
+	if !ok {
+		return nil, &SchemaError{Msg: fmt.Sprintf("response without %s", field)}
+	}
+	var recs []Record
+	if err := json.Unmarshal(raw, &recs); err != nil {
+		return nil, &SchemaError{Msg: fmt.Sprintf("invalid %s: %v", field, err)}
+	}
+	return recs, nil
+}
+
+func decodeNDJSON(r io.Reader) ([]Record, error) {
+	var recs []Record
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		if len(strings.TrimSpace(sc.Text())) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return recs, &SchemaError{Msg: fmt.Sprintf("invalid NDJSON on line %d: %v", line, err)}
+		}
+		recs = append(recs, rec)
+	}
+	return recs, sc.Err()
+}
+
+// GetIPNS returns the IPNS record of a name, which must be a key (not a
+// DNSLink domain). It returns nil if the endpoint doesn't have one.
+func (c *Client) GetIPNS(ctx context.Context, name string) ([]byte, error) {
+	key, err := PeerCID(name)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.get(ctx, IPNS, key, IPNSRecord)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, &StatusError{URL: resp.Request.URL.String(), Code: resp.StatusCode}
+	}
+	ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if ct != IPNSRecord {
+		return nil, &SchemaError{Msg: fmt.Sprintf("Content-Type is %q, expected %s", resp.Header.Get("Content-Type"), IPNSRecord)}
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxIPNSRecord+1))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(b) == 0:
+		return nil, &SchemaError{Msg: "empty IPNS record"}
+	case len(b) > maxIPNSRecord:
+		return nil, &SchemaError{Msg: fmt.Sprintf("IPNS record larger than %d bytes", maxIPNSRecord)}
+	}
+	return b, nil
+}
+
+func (c *Client) get(ctx context.Context, kind, key, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL+"/routing/v1/"+kind+"/"+key, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	return c.Client.Do(req)
+}
+
+// ParsePeerID parses a peer ID given in base58 or as a CID.
+func ParsePeerID(id string) (mh.Multihash, error) {
+	if m, err := mh.FromB58String(id); err == nil {
+		return m, nil
+	}
+	c, err := cid.Decode(id)
+	if err != nil {
+		return nil, fmt.Errorf("not a peer ID: %w", err)
+	}
+	if c.Type() != cid.Libp2pKey {
+		return nil, fmt.Errorf("not a peer ID: CID codec isn't libp2p-key")
+	}
+	return c.Hash(), nil
+}
+
+// PeerCID converts a peer ID or IPNS key to the CIDv1 form (libp2p-key,
+// base36) the spec asks for in paths.
+func PeerCID(id string) (string, error) {
+	m, err := ParsePeerID(id)
+	if err != nil {
+		return "", err
+	}
+	return cid.NewCidV1(cid.Libp2pKey, m).StringOfBase(multibase.Base36)
+}
@@ -0,0 +1,192 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	peerID    = "12D3KooWDpJ7As7BWAwRMfu1VU2WCqNjvq387JEYKDBj4kx6nXTN"
+	peerKey   = "k51qzi5uqu5dhnwe629wdlncpql6frppdpwnz4wtlcw816aysd5wwlk63g4wmh"
+	peerAddr  = "/ip4/127.0.0.1/tcp/4001"
+	testCID   = "bafkreidik6mq5hkhcsd55e4htdv4pxtf3w6fundumgt7sq7fuaq56acvnu"
+	peerJSON  = `{"Schema":"peer","ID":"` + peerID + `","Addrs":["` + peerAddr + `"],"Protocols":["transport-bitswap"]}`
+	otherJSON = `{"Schema":"future","Whatever":1}`
+)
+
+// response is what the test server replies with.
+type response struct {
+	status int
+	ct     string
+	body   string
+}
+
+// serve starts a server that replies with resp, and records the path and
+// Accept header of the last request.
+func serve(t *testing.T, resp response) (*Client, *http.Request) {
+	t.Helper()
+	var req http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = *r
+		if resp.ct != "" {
+			w.Header().Set("Content-Type", resp.ct)
+		}
+		if resp.status != 0 {
+			w.WriteHeader(resp.status)
+		}
+		w.Write([]byte(resp.body))
+	}))
+	t.Cleanup(srv.Close)
+	return New(srv.URL + "/"), &req
+}
+
+func TestRecords(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		kind   string
+		accept string
+		resp   response
+		// the number of records expected
+		n int
+		// the expected error: "schema", "status" or "" for none
+		err string
+	}{
+		{"providers", Providers, JSON, response{ct: JSON, body: `{"Providers":[` + peerJSON + `,` + otherJSON + `]}`}, 2, ""},
+		{"peers", Peers, JSON, response{ct: JSON, body: `{"Peers":[` + peerJSON + `]}`}, 1, ""},
+		{"no providers", Providers, JSON, response{ct: JSON, body: `{"Providers":[]}`}, 0, ""},
+		{"not found", Providers, JSON, response{status: http.StatusNotFound}, 0, ""},
+		{"content type with params", Providers, JSON, response{ct: JSON + "; charset=utf-8", body: `{"Providers":[` + peerJSON + `]}`}, 1, ""},
+		{"ndjson", Providers, NDJSON, response{ct: NDJSON, body: peerJSON + "\n\n" + otherJSON + "\n"}, 2, ""},
+		{"ndjson without final newline", Peers, NDJSON, response{ct: NDJSON, body: peerJSON}, 1, ""},
+		{"server error", Providers, JSON, response{status: http.StatusInternalServerError}, 0, "status"},
+		{"wrong content type", Providers, JSON, response{ct: "text/plain", body: `{"Providers":[]}`}, 0, "schema"},
+		{"json instead of ndjson", Providers, NDJSON, response{ct: JSON, body: `{"Providers":[]}`}, 0, "schema"},
+		{"invalid json", Providers, JSON, response{ct: JSON, body: `{"Providers":`}, 0, "schema"},
+		{"wrong field", Peers, JSON, response{ct: JSON, body: `{"Providers":[` + peerJSON + `]}`}, 0, "schema"},
+		{"field not a list", Providers, JSON, response{ct: JSON, body: `{"Providers":{}}`}, 0, "schema"},
+		{"invalid ndjson line", Providers, NDJSON, response{ct: NDJSON, body: peerJSON + "\n{\n"}, 1, "schema"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, req := serve(t, tc.resp)
+			recs, err := c.Records(context.Background(), tc.kind, testCID, tc.accept)
+			if got := req.URL.Path; got != "/routing/v1/"+tc.kind+"/"+testCID {
+				t.Errorf("unexpected path %s", got)
+			}
+			if got := req.Header.Get("Accept"); got != tc.accept {
+				t.Errorf("expected Accept %s, got %s", tc.accept, got)
+			}
+			checkErr(t, err, tc.err)
+			if len(recs) != tc.n {
+				t.Fatalf("expected %d records, got %d: %v", tc.n, len(recs), recs)
+			}
+			if tc.n > 0 && (recs[0].ID != peerID || len(recs[0].Addrs) != 1 || recs[0].Addrs[0] != peerAddr) {
+				t.Errorf("unexpected record %+v", recs[0])
+			}
+		})
+	}
+}
+
+func TestFindPeers(t *testing.T) {
+	c, req := serve(t, response{ct: JSON, body: `{"Peers":[` + peerJSON + `]}`})
+	recs, err := c.FindPeers(context.Background(), peerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 {
+		t.Fatalf("expected 1 record, got %v", recs)
+	}
+	// the spec asks for the peer ID as a CID in the path
+	if got := req.URL.Path; got != "/routing/v1/peers/"+peerKey {
+		t.Errorf("unexpected path %s", got)
+	}
+	if _, err := c.FindPeers(context.Background(), "not-a-peer"); err == nil {
+		t.Error("expected an error for an invalid peer ID")
+	}
+}
+
+func TestGetIPNS(t *testing.T) {
+	record := string(bytes.Repeat([]byte{1}, 300))
+	for _, tc := range []struct {
+		name string
+		resp response
+		// the expected record length
+		n   int
+		err string
+	}{
+		{"record", response{ct: IPNSRecord, body: record}, len(record), ""},
+		{"not found", response{status: http.StatusNotFound}, 0, ""},
+		{"server error", response{status: http.StatusBadGateway}, 0, "status"},
+		{"wrong content type", response{ct: "text/plain", body: record}, 0, "schema"},
+		{"empty record", response{ct: IPNSRecord}, 0, "schema"},
+		{"oversized record", response{ct: IPNSRecord, body: strings.Repeat("x", maxIPNSRecord+1)}, 0, "schema"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, req := serve(t, tc.resp)
+			b, err := c.GetIPNS(context.Background(), peerID)
+			if got := req.URL.Path; got != "/routing/v1/ipns/"+peerKey {
+				t.Errorf("unexpected path %s", got)
+			}
+			if got := req.Header.Get("Accept"); got != IPNSRecord {
+				t.Errorf("expected Accept %s, got %s", IPNSRecord, got)
+			}
+			checkErr(t, err, tc.err)
+			if len(b) != tc.n {
+				t.Fatalf("expected a record of %d bytes, got %d", tc.n, len(b))
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		rec   Record
+		valid bool
+	}{
+		{"peer", Record{Schema: SchemaPeer, ID: peerID, Addrs: []string{peerAddr}}, true},
+		{"peer as CID", Record{Schema: SchemaPeer, ID: peerKey}, true},
+		{"unknown schema", Record{Schema: "future"}, true},
+		{"no schema", Record{ID: peerID}, false},
+		{"invalid ID", Record{Schema: SchemaPeer, ID: "nope"}, false},
+		{"CID that isn't a peer", Record{Schema: SchemaPeer, ID: testCID}, false},
+		{"invalid address", Record{Schema: SchemaPeer, ID: peerID, Addrs: []string{"/ip4/nope"}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.rec.Validate()
+			if tc.valid {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			checkErr(t, err, "schema")
+		})
+	}
+}
+
+// checkErr checks that err is a *SchemaError or *StatusError as kind says,
+// or nil if kind is empty.
+func checkErr(t *testing.T, err error, kind string) {
+	t.Helper()
+	var schemaErr *SchemaError
+	var statusErr *StatusError
+	switch kind {
+	case "":
+		if err != nil {
+			t.Fatal(err)
+		}
+	case "schema":
+		if !errors.As(err, &schemaErr) {
+			t.Fatalf("expected a schema error, got %v", err)
+		}
+	case "status":
+		if !errors.As(err, &statusErr) {
+			t.Fatalf("expected a status error, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package sink
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
+)
+
+// JSON writes every result as a line of JSON, e.g. to keep a history
+// of runs in a file.
+type JSON struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewJSON(w io.Writer) *JSON {
+	return &JSON{
+		enc: json.NewEncoder(w),
+	}
+}
+
+type jsonPhase struct {
+	Name string  `json:"name"`
+	Ms   float64 `json:"ms"`
+}
+
+type jsonResult struct {
+	Task       string            `json:"task"`
+	Gateway    string            `json:"gateway"`
+	Provider   string            `json:"provider,omitempty"`
+	Attempt    int               `json:"attempt"`
+	Start      time.Time         `json:"start"`
+	Ms         float64           `json:"ms"`
+	Status     task.Status       `json:"status"`
+	Err        string            `json:"error,omitempty"`
+	Kind       task.Kind         `json:"kind,omitempty"`
+	Phases     []jsonPhase       `json:"phases,omitempty"`
+	Bytes      int64             `json:"bytes,omitempty"`
+	HTTPStatus int               `json:"http_status,omitempty"`
+	CID        string            `json:"cid,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+func (j *JSON) Record(res *task.Result) {
+	out := jsonResult{
+		Task:       res.Task,
+		Gateway:    res.Gateway,
+		Provider:   res.Provider,
+		Attempt:    res.Attempt,
+		Start:      res.Start,
+		Ms:         ms(res.Duration),
+		Status:     res.Status,
+		Kind:       res.Kind,
+		Bytes:      res.Bytes,
+		HTTPStatus: res.HTTPStatus,
+		CID:        res.CID,
+		Attributes: res.Attributes,
+	}
+	if res.Err != nil {
+		out.Err = res.Err.Error()
+	}
+	for _, p := range res.Phases {
+		out.Phases = append(out.Phases, jsonPhase{Name: p.Name, Ms: ms(p.Duration)})
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.enc.Encode(out); err != nil {
+		log.Errorw("failed to write result", "err", err)
+	}
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
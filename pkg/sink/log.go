@@ -0,0 +1,43 @@
+package sink
+
+import (
+	logging "github.com/ipfs/go-log"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
+)
+
+var log = logging.Logger("results")
+
+// Log writes a summary of every result to the "results" logger.
+type Log struct{}
+
+func (Log) Record(res *task.Result) {
+	kv := []interface{}{
+		"task", res.Task,
+		"gateway", res.Gateway,
+		"attempt", res.Attempt,
+		"status", res.Status,
+		"ms", res.Duration.Milliseconds(),
+	}
+	if res.Provider != "" {
+		kv = append(kv, "provider", res.Provider)
+	}
+	if res.CID != "" {
+		kv = append(kv, "cid", res.CID)
+	}
+	if res.HTTPStatus != 0 {
+		kv = append(kv, "http_status", res.HTTPStatus, "bytes", res.Bytes)
+	}
+	for _, p := range res.Phases {
+		kv = append(kv, p.Name+"_ms", p.Duration.Milliseconds())
+	}
+	for k, v := range res.Attributes {
+		kv = append(kv, k, v)
+	}
+	if res.Err != nil {
+		kv = append(kv, "kind", res.Kind, "err", res.Err)
+		log.Warnw("task finished", kv...)
+		return
+	}
+	log.Infow("task finished", kv...)
+}
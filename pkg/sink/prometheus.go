@@ -0,0 +1,59 @@
+package sink
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
+)
+
+// Prometheus exports the results of every task with the same set of
+// metrics, labelled by task, gateway and, for pinning tasks, provider.
+type Prometheus struct {
+	runs   *prometheus.CounterVec
+	phases *prometheus.HistogramVec
+	bytes  *prometheus.CounterVec
+}
+
+// NewPrometheus creates the sink and registers its collectors.
+func NewPrometheus() *Prometheus {
+	p := &Prometheus{
+		runs: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "gatewaymonitor",
+				Subsystem: "result",
+				Name:      "count",
+			},
+			[]string{"task", "gateway", "provider", "status"},
+		),
+		phases: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "gatewaymonitor",
+				Subsystem: "result",
+				Name:      "phase_seconds",
+				Buckets:   prometheus.ExponentialBuckets(0.01, 2, 16),
+			},
+			[]string{"task", "gateway", "provider", "phase"},
+		),
+		bytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "gatewaymonitor",
+				Subsystem: "result",
+				Name:      "bytes_count",
+			},
+			[]string{"task", "gateway", "provider"},
+		),
+	}
+	prometheus.Register(p.runs)
+	prometheus.Register(p.phases)
+	prometheus.Register(p.bytes)
+	return p
+}
+
+func (p *Prometheus) Record(res *task.Result) {
+	p.runs.WithLabelValues(res.Task, res.Gateway, res.Provider, string(res.Status)).Inc()
+	p.phases.WithLabelValues(res.Task, res.Gateway, res.Provider, "total").Observe(res.Duration.Seconds())
+	for _, ph := range res.Phases {
+		p.phases.WithLabelValues(res.Task, res.Gateway, res.Provider, ph.Name).Observe(ph.Duration.Seconds())
+	}
+	p.bytes.WithLabelValues(res.Task, res.Gateway, res.Provider).Add(float64(res.Bytes))
+}
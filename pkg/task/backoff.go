@@ -0,0 +1,40 @@
+package task
+
+import (
+	"time"
+)
+
+// DefaultBackoff is used between retries of tasks that don't set their own.
+var DefaultBackoff = Backoff{
+	Initial:    10 * time.Second,
+	Max:        5 * time.Minute,
+	Multiplier: 2,
+}
+
+// Backoff is an exponential backoff policy. A Multiplier of 1 waits
+// Initial between every attempt.
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+}
+
+// Delay returns how long to wait after the given failed attempt,
+// counting from 0.
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := float64(b.Initial)
+	mult := b.Multiplier
+	if mult < 1 {
+		mult = 1
+	}
+	for i := 0; i < attempt; i++ {
+		d *= mult
+		if b.Max > 0 && d >= float64(b.Max) {
+			return b.Max
+		}
+	}
+	if b.Max > 0 && d > float64(b.Max) {
+		return b.Max
+	}
+	return time.Duration(d)
+}
@@ -0,0 +1,74 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Kind classifies why a task run failed.
+type Kind string
+
+const (
+	// The local IPFS node failed, e.g. to add or publish content.
+	KindLocalNode Kind = "local-node"
+	// The remote pinning service failed.
+	KindPinningService Kind = "pinning-service"
+	// The gateway couldn't be reached or the connection broke.
+	KindNetwork Kind = "network"
+	// The gateway responded with an unexpected status or headers.
+	KindHTTPStatus Kind = "http-status"
+	// The run took longer than it was allowed to.
+	KindTimeout Kind = "timeout"
+	// The gateway served the wrong content.
+	KindContentMismatch Kind = "content-mismatch"
+	// Anything else, including errors that weren't classified.
+	KindInternal Kind = "internal"
+)
+
+// Error is an error of a known Kind. Tasks return it, possibly wrapped,
+// so that the engine can tell failures apart.
+type Error struct {
+	Kind Kind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Errorf formats an error of the given kind, like fmt.Errorf.
+func Errorf(kind Kind, format string, a ...interface{}) error {
+	return &Error{Kind: kind, Err: fmt.Errorf(format, a...)}
+}
+
+// WrapError gives err a kind. It returns nil if err is nil.
+func WrapError(kind Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// KindOf classifies err. Errors caused by a deadline are timeouts whatever
+// their kind, and errors without a kind are internal.
+func KindOf(err error) Kind {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return KindTimeout
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return KindInternal
+}
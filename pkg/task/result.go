@@ -0,0 +1,90 @@
+package task
+
+import (
+	"time"
+)
+
+// Status classifies the outcome of a task run.
+type Status string
+
+const (
+	// The gateway behaved as expected.
+	StatusPass Status = "pass"
+	// The check completed, but the gateway misbehaved,
+	// e.g. it served the wrong content or status code.
+	StatusFail Status = "fail"
+	// The check could not be completed.
+	StatusError Status = "error"
+)
+
+// Phase is how long one step of a run took.
+type Phase struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Result describes what happened in a single run of a task against
+// a gateway. Tasks fill in what they measured; the engine fills in
+// the rest and hands the result to every Sink.
+type Result struct {
+	Task    string
+	Gateway string
+	// Provider is the pinning service of pinning tasks.
+	Provider string
+	Attempt  int
+	Start    time.Time
+	// Duration of the whole run.
+	Duration time.Duration
+	Status   Status
+	Err      error
+	// Kind classifies Err.
+	Kind   Kind
+	Phases []Phase
+	// Bytes received from the gateway.
+	Bytes      int64
+	HTTPStatus int
+	CID        string
+	Attributes map[string]string
+}
+
+func NewResult() *Result {
+	return &Result{
+		Attributes: make(map[string]string),
+	}
+}
+
+// AddPhase records how long a step of the run took.
+func (r *Result) AddPhase(name string, d time.Duration) {
+	r.Phases = append(r.Phases, Phase{Name: name, Duration: d})
+}
+
+// Phase returns the duration of the named phase, if it was recorded.
+func (r *Result) Phase(name string) (time.Duration, bool) {
+	for _, p := range r.Phases {
+		if p.Name == name {
+			return p.Duration, true
+		}
+	}
+	return 0, false
+}
+
+// Set records a free-form attribute.
+func (r *Result) Set(key, value string) {
+	if r.Attributes == nil {
+		r.Attributes = make(map[string]string)
+	}
+	r.Attributes[key] = value
+}
+
+// Fail marks the result as a gateway failure and returns err,
+// so that tasks can write `return res, res.Fail(err)`.
+func (r *Result) Fail(err error) error {
+	r.Status = StatusFail
+	r.Err = err
+	return err
+}
+
+// Sink consumes task results, e.g. to export or store them.
+type Sink interface {
+	Record(*Result)
+}
@@ -4,16 +4,23 @@ import (
 	"context"
 
 	shell "github.com/ipfs/go-ipfs-api"
-	pinning "github.com/ipfs/go-pinning-service-http-client"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
 )
 
 type TerminalTask struct {
 	Done chan bool
 }
 
-func (t *TerminalTask) Run(context.Context, *shell.Shell, *pinning.Client, string) error {
-	t.Done <- true
-	return nil
+func (t *TerminalTask) Run(context.Context, *shell.Shell, *provider.Provider, gateway.Gateway) (*Result, error) {
+	// the engine runs every task once per gateway, but we only
+	// need to signal completion once.
+	select {
+	case t.Done <- true:
+	default:
+	}
+	return nil, nil
 }
 
 func (t *TerminalTask) Registration() *Registration {
@@ -2,19 +2,85 @@ package task
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 
 	shell "github.com/ipfs/go-ipfs-api"
-	pinning "github.com/ipfs/go-pinning-service-http-client"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
 )
 
 type Task interface {
-	Run(context.Context, *shell.Shell, *pinning.Client, string) error
+	// Run runs the task once against a gateway (the zero Gateway for
+	// tasks that set Registration.NoGateway), and against a pinning
+	// service for tasks that set Registration.Pinning (the provider is nil
+	// otherwise, or if none is configured). The result should be
+	// returned even when the run fails, with whatever was measured.
+	// A nil result is not reported to the sinks.
+	Run(context.Context, *shell.Shell, *provider.Provider, gateway.Gateway) (*Result, error)
 	Registration() *Registration
 }
 
+// DefaultTimeout bounds each attempt of tasks that don't set a Timeout.
+const DefaultTimeout = 10 * time.Minute
+
 type Registration struct {
+	// Name identifies the task in logs and engine metrics.
+	Name       string
 	Collectors []prometheus.Collector
 	Schedule   string
+	// Gateways, if set, restricts the task to these gateways instead
+	// of every gateway the engine is watching.
+	Gateways []gateway.Gateway
+	// Pinning tasks are run against every pinning service provider
+	// the engine knows, as well as every gateway.
+	Pinning bool
+	// NoGateway tasks don't request anything from a gateway. They are
+	// run once (per provider for pinning tasks) with a zero Gateway,
+	// instead of once per gateway.
+	NoGateway bool
+	// Group, if set, puts the task in a concurrency group. Tasks in the
+	// same group share a limit on how many of them may run at once,
+	// on top of the engine's worker limit.
+	Group string
+	// Timeout bounds each attempt. Zero means DefaultTimeout.
+	Timeout time.Duration
+	// Retries is how many times a failed run is retried against the
+	// same gateway before the engine gives up and reports the error.
+	Retries int
+	// Backoff is the wait between retries. Nil means DefaultBackoff.
+	Backoff *Backoff
+}
+
+// Name returns the task's registered name, or its type if it has none.
+func Name(t Task) string {
+	if name := t.Registration().Name; name != "" {
+		return name
+	}
+	return fmt.Sprintf("%T", t)
+}
+
+// rescheduled is a task with a copy of its registration, see WithSchedule.
+type rescheduled struct {
+	Task
+	reg *Registration
+}
+
+func (t *rescheduled) Registration() *Registration {
+	return t.reg
+}
+
+// WithSchedule returns t with a different schedule. The registration of t
+// is copied rather than changed, since the engine may be reading it.
+// The returned task shares the collectors of t.
+func WithSchedule(t Task, schedule string) Task {
+	reg := *t.Registration()
+	reg.Schedule = schedule
+	if r, ok := t.(*rescheduled); ok {
+		t = r.Task
+	}
+	return &rescheduled{Task: t, reg: &reg}
 }
@@ -0,0 +1,101 @@
+// Package verify checks content streamed from a gateway without holding
+// it in memory.
+package verify
+
+import (
+	"fmt"
+	"io"
+)
+
+// MismatchError reports where the received content first differed
+// from what was expected.
+type MismatchError struct {
+	// Offset of the first byte that differs.
+	Offset int64
+	// Expected and Received sizes.
+	Expected int64
+	Received int64
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("content mismatch at byte offset %d (expected %d bytes, received %d)", e.Offset, e.Expected, e.Received)
+}
+
+func min(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Verifier is written the received content and reports whether it
+// matched once everything was written.
+type Verifier interface {
+	io.Writer
+	// Verify returns a *MismatchError if the content didn't match.
+	Verify() error
+}
+
+type readerVerifier struct {
+	want     io.Reader
+	size     int64
+	offset   int64
+	buf      []byte
+	mismatch *MismatchError
+}
+
+// NewReaderVerifier compares the received content byte for byte with
+// the expected content read from r, which is size bytes long.
+func NewReaderVerifier(r io.Reader, size int64) Verifier {
+	return &readerVerifier{
+		want: r,
+		size: size,
+	}
+}
+
+func (v *readerVerifier) Write(p []byte) (int, error) {
+	if v.mismatch != nil {
+		v.mismatch.Received += int64(len(p))
+		return len(p), nil
+	}
+	if cap(v.buf) < len(p) {
+		v.buf = make([]byte, len(p))
+	}
+	want := v.buf[:len(p)]
+	n, _ := io.ReadFull(v.want, want)
+	for i := 0; i < n; i++ {
+		if want[i] != p[i] {
+			v.fail(v.offset+int64(i), len(p))
+			return len(p), nil
+		}
+	}
+	if n < len(p) {
+		// received more than expected
+		v.fail(v.offset+int64(n), len(p))
+		return len(p), nil
+	}
+	v.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (v *readerVerifier) fail(at int64, written int) {
+	v.mismatch = &MismatchError{
+		Offset:   at,
+		Expected: v.size,
+		Received: v.offset + int64(written),
+	}
+}
+
+func (v *readerVerifier) Verify() error {
+	if v.mismatch != nil {
+		return v.mismatch
+	}
+	if v.offset != v.size {
+		return &MismatchError{
+			Offset:   min(v.offset, v.size),
+			Expected: v.size,
+			Received: v.offset,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package tasks
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	shell "github.com/ipfs/go-ipfs-api"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// newDirectory builds an in-memory directory from files keyed by their
+// slash separated path, creating the intermediate directories.
+func newDirectory(fls map[string]files.Node) files.Directory {
+	type dir map[string]interface{}
+	root := dir{}
+	for path, nd := range fls {
+		parts := strings.Split(strings.Trim(path, "/"), "/")
+		d := root
+		for _, part := range parts[:len(parts)-1] {
+			sub, ok := d[part].(dir)
+			if !ok {
+				sub = dir{}
+				d[part] = sub
+			}
+			d = sub
+		}
+		d[parts[len(parts)-1]] = nd
+	}
+	var build func(d dir) files.Directory
+	build = func(d dir) files.Directory {
+		nodes := make(map[string]files.Node, len(d))
+		for name, v := range d {
+			switch v := v.(type) {
+			case dir:
+				nodes[name] = build(v)
+			case files.Node:
+				nodes[name] = v
+			}
+		}
+		return files.NewMapDirectory(nodes)
+	}
+	return build(root)
+}
+
+// addDirectory adds a directory to the local IPFS node and returns
+// the CID of its root.
+func addDirectory(ctx context.Context, sh *shell.Shell, dir files.Directory) (string, error) {
+	slf := files.NewSliceDirectory([]files.DirEntry{files.FileEntry("dir", dir)})
+	reader := files.NewMultiFileReader(slf, true)
+
+	resp, err := sh.Request("add").
+		Option("recursive", true).
+		Body(reader).
+		Send(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Close()
+	if resp.Error != nil {
+		return "", resp.Error
+	}
+
+	// the root is the last object added
+	dec := json.NewDecoder(resp.Output)
+	var root string
+	for {
+		var out struct {
+			Hash string
+		}
+		if err := dec.Decode(&out); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return "", err
+		}
+		root = out.Hash
+	}
+	if root == "" {
+		return "", errors.New("no results received")
+	}
+	return root, nil
+}
+
+// dagBlocks lists the CIDs of every block in the DAG under root,
+// including root itself, as known to the local IPFS node.
+func dagBlocks(sh *shell.Shell, root string) ([]string, error) {
+	refs, err := sh.Refs(root, true)
+	if err != nil {
+		return nil, err
+	}
+	blocks := []string{root}
+	seen := map[string]bool{root: true}
+	for ref := range refs {
+		if !seen[ref] {
+			seen[ref] = true
+			blocks = append(blocks, ref)
+		}
+	}
+	return blocks, nil
+}
+
+// unixfsHAMTShard is the UnixFS type of the nodes of a sharded directory.
+const unixfsHAMTShard = 5
+
+// unixfsType returns the UnixFS type of a dag-pb block, the Type field of
+// the UnixFS message in the Data field of the node.
+func unixfsType(block []byte) (uint64, error) {
+	_, data, err := protoField(block, 1)
+	if err != nil {
+		return 0, fmt.Errorf("not a dag-pb node: %w", err)
+	}
+	typ, _, err := protoField(data, 1)
+	if err != nil {
+		return 0, fmt.Errorf("not a UnixFS node: %w", err)
+	}
+	return typ, nil
+}
+
+// protoField returns the first occurrence of field in a protobuf message:
+// its value if it is a varint, or its bytes if it is length delimited.
+func protoField(msg []byte, field uint64) (uint64, []byte, error) {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, nil, errors.New("invalid field key")
+		}
+		msg = msg[n:]
+		var (
+			v uint64
+			b []byte
+		)
+		switch key & 7 {
+		case 0:
+			v, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, nil, errors.New("invalid varint")
+			}
+			msg = msg[n:]
+		case 2:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || l > uint64(len(msg)-n) {
+				return 0, nil, errors.New("truncated field")
+			}
+			b = msg[n : n+int(l)]
+			msg = msg[n+int(l):]
+		default:
+			return 0, nil, fmt.Errorf("unexpected wire type %d", key&7)
+		}
+		if key>>3 == field {
+			return v, b, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("field %d not found", field)
+}
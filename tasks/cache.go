@@ -0,0 +1,304 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	shell "github.com/ipfs/go-ipfs-api"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/fetch"
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
+	"github.com/coryschwartz/gateway-monitor/pkg/verify"
+)
+
+// DefaultCacheFetches is how many times the cache task fetches the same
+// content by default.
+const DefaultCacheFetches = 3
+
+const (
+	// The first fetch of new content is cold, the following ones
+	// may be served from a cache.
+	cacheCold = "cold"
+	cacheWarm = "warm"
+
+	// What the cache headers say about a response.
+	cacheHit     = "hit"
+	cacheMiss    = "miss"
+	cacheUnknown = "unknown"
+)
+
+// cacheStatusHeaders are the headers caches and CDNs report hits in,
+// in order of preference. Cache-Status is RFC 9211, the others are
+// common non-standard ones.
+var cacheStatusHeaders = []string{
+	"Cache-Status",
+	"X-Cache",
+	"X-Cache-Status",
+	"CF-Cache-Status",
+	"X-Proxy-Cache",
+}
+
+// CacheCheck fetches the same freshly added content several times in a row,
+// to compare cold and warm retrieval and check that responses from /ipfs/,
+// which are immutable, are cached in front of the gateway.
+type CacheCheck struct {
+	reg             *task.Registration
+	size            int
+	fetches         int
+	ttfb_time       *prometheus.HistogramVec
+	fetch_time      *prometheus.HistogramVec
+	cache_status    *prometheus.CounterVec
+	max_age         *prometheus.GaugeVec
+	age             *prometheus.GaugeVec
+	revalidate_time *prometheus.HistogramVec
+	fails           *prometheus.CounterVec
+	errors          *prometheus.CounterVec
+}
+
+// NewCacheCheck fetches content of the given size fetches times, the first
+// of which is cold, and then revalidates it with its ETag.
+func NewCacheCheck(schedule string, size int, fetches int) *CacheCheck {
+	ttfb_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "cache",
+			Name:      fmt.Sprintf("%d_ttfb_seconds", size),
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+		},
+		[]string{"gateway", "fetch"},
+	)
+	fetch_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "cache",
+			Name:      fmt.Sprintf("%d_fetch_seconds", size),
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+		},
+		[]string{"gateway", "fetch"},
+	)
+	cache_status := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "cache",
+			Name:      "status_count",
+		},
+		[]string{"gateway", "fetch", "status"},
+	)
+	max_age := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "cache",
+			Name:      "max_age_seconds",
+		},
+		[]string{"gateway"},
+	)
+	age := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "cache",
+			Name:      "age_seconds",
+		},
+		[]string{"gateway"},
+	)
+	revalidate_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "cache",
+			Name:      "revalidate_seconds",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+		},
+		[]string{"gateway"},
+	)
+	fails := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "cache",
+			Name:      "fail_count",
+		},
+		[]string{"gateway"},
+	)
+	errors := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "cache",
+			Name:      "error_count",
+		},
+		[]string{"gateway"},
+	)
+	reg := task.Registration{
+		Name:     fmt.Sprintf("cache_%d", size),
+		Schedule: schedule,
+		Group:    BandwidthGroup,
+		Collectors: []prometheus.Collector{
+			ttfb_time,
+			fetch_time,
+			cache_status,
+			max_age,
+			age,
+			revalidate_time,
+			fails,
+			errors,
+		},
+	}
+	return &CacheCheck{
+		reg:             &reg,
+		size:            size,
+		fetches:         fetches,
+		ttfb_time:       ttfb_time,
+		fetch_time:      fetch_time,
+		cache_status:    cache_status,
+		max_age:         max_age,
+		age:             age,
+		revalidate_time: revalidate_time,
+		fails:           fails,
+		errors:          errors,
+	}
+}
+
+func (t *CacheCheck) Run(ctx context.Context, sh *shell.Shell, ps *provider.Provider, gw gateway.Gateway) (*task.Result, error) {
+	res := task.NewResult()
+
+	payload, err := NewPayload(t.size, ShapeFile)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, err
+	}
+	log.Infow("generating random data", "bytes", t.size, "seed", payload.Seed)
+	res.Set("seed", strconv.FormatInt(payload.Seed, 10))
+
+	root, unpin, err := addPayload(res, sh, payload, t.errors.WithLabelValues(gw.URL))
+	if err != nil {
+		return res, err
+	}
+	defer unpin()
+	cidstr := root.String()
+
+	url := gw.Path("/ipfs/" + cidstr)
+	res.Set("url", url)
+	var etag string
+	for i := 0; i < t.fetches; i++ {
+		kind := cacheWarm
+		if i == 0 {
+			kind = cacheCold
+		}
+		log.Infow("fetching from gateway", "url", url, "fetch", i, "kind", kind)
+		v := verify.NewReaderVerifier(payload.Reader(), int64(t.size))
+		fr, err := fetchCacheable(ctx, url, v)
+		if i == 0 {
+			recordFetch(res, fr)
+		} else if fr != nil {
+			res.Bytes += fr.Size
+		}
+		if err != nil {
+			t.errors.WithLabelValues(gw.URL).Inc()
+			return res, task.Errorf(task.KindNetwork, "failed to fetch from gateway: %w", err)
+		}
+		if err := checkStatus(fr, http.StatusOK); err != nil {
+			t.fails.WithLabelValues(gw.URL).Inc()
+			return res, res.Fail(fmt.Errorf("failed to fetch generated content from gateway: %s: %w", url, err))
+		}
+		if err := checkContent(res, v); err != nil {
+			t.fails.WithLabelValues(gw.URL).Inc()
+			return res, res.Fail(fmt.Errorf("expected response from gateway to match generated content: %s: %w", url, err))
+		}
+
+		status, header := cacheStatus(fr.Header)
+		log.Infow("fetched from gateway", "fetch", i, "ttfb_ms", fr.TTFB.Milliseconds(), "cache_status", status, "cache_header", header)
+		res.AddPhase(fmt.Sprintf("fetch_%d_ttfb", i), fr.TTFB)
+		t.ttfb_time.WithLabelValues(gw.URL, kind).Observe(fr.TTFB.Seconds())
+		t.fetch_time.WithLabelValues(gw.URL, kind).Observe(fr.Total.Seconds())
+		t.cache_status.WithLabelValues(gw.URL, kind, status).Inc()
+
+		prefix := fmt.Sprintf("fetch_%d_", i)
+		res.Set(prefix+"cache_status", status)
+		for _, h := range []struct{ attr, value string }{
+			{"cache_control", fr.Header.Get("Cache-Control")},
+			{"age", fr.Header.Get("Age")},
+			{"cache_header", header},
+			{"etag", fr.Header.Get("ETag")},
+		} {
+			if h.value != "" {
+				res.Set(prefix+h.attr, h.value)
+			}
+		}
+		if age, err := strconv.Atoi(fr.Header.Get("Age")); err == nil {
+			t.age.WithLabelValues(gw.URL).Set(float64(age))
+		}
+		if maxAge, ok := cacheMaxAge(fr.Header); ok {
+			t.max_age.WithLabelValues(gw.URL).Set(float64(maxAge))
+		}
+		etag = fr.Header.Get("ETag")
+	}
+
+	if etag == "" {
+		t.fails.WithLabelValues(gw.URL).Inc()
+		return res, res.Fail(task.Errorf(task.KindHTTPStatus, "expected an ETag in the response: %s", url))
+	}
+	log.Infow("revalidating with gateway", "url", url, "etag", etag)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, err
+	}
+	req.Header.Set("If-None-Match", etag)
+	fr, err := fetch.Default.Do(req, nil)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, task.Errorf(task.KindNetwork, "failed to revalidate with gateway: %w", err)
+	}
+	res.AddPhase("revalidate", fr.Total)
+	res.Set("revalidate_status", strconv.Itoa(fr.StatusCode))
+	if fr.StatusCode != http.StatusNotModified {
+		t.fails.WithLabelValues(gw.URL).Inc()
+		return res, res.Fail(task.Errorf(task.KindHTTPStatus, "expected status 304 for If-None-Match %s, got %d: %s", etag, fr.StatusCode, url))
+	}
+	t.revalidate_time.WithLabelValues(gw.URL).Observe(fr.Total.Seconds())
+
+	return res, nil
+}
+
+func (t *CacheCheck) Registration() *task.Registration {
+	return t.reg
+}
+
+// fetchCacheable fetches url over a new connection, so that warm fetches
+// aren't faster only because the connection was reused.
+func fetchCacheable(ctx context.Context, url string, v verify.Verifier) (*fetch.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Close = true
+	return fetch.Default.Do(req, v)
+}
+
+// cacheStatus tells whether a cache says it served the response, and
+// returns the header that says so.
+func cacheStatus(h http.Header) (string, string) {
+	for _, name := range cacheStatusHeaders {
+		value := h.Get(name)
+		if value == "" {
+			continue
+		}
+		lower := strings.ToLower(strings.ReplaceAll(value, " ", ""))
+		switch {
+		case name == "Cache-Status" && strings.Contains(lower, ";hit"),
+			name != "Cache-Status" && strings.Contains(lower, "hit"):
+			return cacheHit, name + ": " + value
+		default:
+			return cacheMiss, name + ": " + value
+		}
+	}
+	// a cache that doesn't say anything else still sets Age
+	if age, err := strconv.Atoi(h.Get("Age")); err == nil && age > 0 {
+		return cacheHit, "Age: " + h.Get("Age")
+	}
+	return cacheUnknown, ""
+}
@@ -0,0 +1,230 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/ipfs/go-cid"
+	shell "github.com/ipfs/go-ipfs-api"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/car"
+	"github.com/coryschwartz/gateway-monitor/pkg/fetch"
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
+)
+
+// CarCheck fetches freshly added content from the gateway as a CAR,
+// the way trustless clients do, and verifies every block it receives.
+type CarCheck struct {
+	reg        *task.Registration
+	size       int
+	start_time *prometheus.HistogramVec
+	fetch_time *prometheus.HistogramVec
+	blocks     *prometheus.HistogramVec
+	fails      *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+}
+
+func NewCarCheck(schedule string, size int) *CarCheck {
+	start_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "car",
+			Name:      fmt.Sprintf("%d_latency", size),
+		},
+		[]string{"gateway"},
+	)
+	fetch_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "car",
+			Name:      fmt.Sprintf("%d_fetch_time", size),
+		},
+		[]string{"gateway"},
+	)
+	blocks := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "car",
+			Name:      fmt.Sprintf("%d_blocks", size),
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+		},
+		[]string{"gateway"},
+	)
+	fails := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "car",
+			Name:      "fail_count",
+		},
+		[]string{"gateway"},
+	)
+	errors := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "car",
+			Name:      "error_count",
+		},
+		[]string{"gateway"},
+	)
+	reg := task.Registration{
+		Name:     fmt.Sprintf("car_%d", size),
+		Schedule: schedule,
+		Group:    BandwidthGroup,
+		Collectors: []prometheus.Collector{
+			start_time,
+			fetch_time,
+			blocks,
+			fails,
+			errors,
+		},
+	}
+	return &CarCheck{
+		reg:        &reg,
+		size:       size,
+		start_time: start_time,
+		fetch_time: fetch_time,
+		blocks:     blocks,
+		fails:      fails,
+		errors:     errors,
+	}
+}
+
+func (t *CarCheck) Run(ctx context.Context, sh *shell.Shell, ps *provider.Provider, gw gateway.Gateway) (*task.Result, error) {
+	res := task.NewResult()
+
+	payload, err := NewPayload(t.size, ShapeFile)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, err
+	}
+	log.Infow("generating random data", "bytes", t.size, "seed", payload.Seed)
+	res.Set("seed", strconv.FormatInt(payload.Seed, 10))
+
+	// add to local ipfs
+	root, unpin, err := addPayload(res, sh, payload, t.errors.WithLabelValues(gw.URL))
+	if err != nil {
+		return res, err
+	}
+	defer unpin()
+	cidstr := root.String()
+
+	// the CAR must contain every block of the DAG
+	expected, err := dagBlocks(sh, cidstr)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, task.Errorf(task.KindLocalNode, "failed to list blocks on local IPFS node: %w", err)
+	}
+
+	// request a CAR from the gateway, verifying it as it streams in
+	url := gw.Path("/ipfs/" + cidstr + "?format=car")
+	log.Infow("fetching CAR from gateway", "url", url)
+	res.Set("url", url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, err
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.car")
+
+	pr, pw := io.Pipe()
+	verified := make(chan carVerification, 1)
+	go func() {
+		verified <- verifyCar(pr, root)
+		// let the fetch finish even if we stopped reading
+		io.Copy(ioutil.Discard, pr)
+	}()
+	fr, err := fetch.Default.Do(req, pw)
+	pw.CloseWithError(err)
+	cv := <-verified
+	recordFetch(res, fr)
+	if fr != nil && fr.TTFB > 0 {
+		log.Infow("first byte received", "ms", fr.TTFB.Milliseconds())
+		t.start_time.WithLabelValues(gw.URL).Observe(float64(fr.TTFB.Milliseconds()))
+	}
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, task.Errorf(task.KindNetwork, "failed to fetch from gateway: %w", err)
+	}
+	log.Infow("finished download", "ms", fr.Total.Milliseconds(), "blocks", len(cv.seen))
+	t.fetch_time.WithLabelValues(gw.URL).Observe(float64(fr.Total.Milliseconds()))
+	t.blocks.WithLabelValues(gw.URL).Observe(float64(len(cv.seen)))
+	res.Set("blocks", strconv.Itoa(len(cv.seen)))
+
+	log.Info("checking result")
+	if fr.StatusCode != http.StatusOK {
+		t.fails.WithLabelValues(gw.URL).Inc()
+		return res, res.Fail(task.Errorf(task.KindHTTPStatus, "expected status 200 for CAR request, got %d: %s", fr.StatusCode, url))
+	}
+	if ct := fr.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/vnd.ipld.car") {
+		t.fails.WithLabelValues(gw.URL).Inc()
+		return res, res.Fail(task.Errorf(task.KindHTTPStatus, "expected CAR content type, got %q: %s", ct, url))
+	}
+	if cv.err != nil {
+		t.fails.WithLabelValues(gw.URL).Inc()
+		return res, res.Fail(task.Errorf(task.KindContentMismatch, "invalid CAR from gateway: %s: %w", url, cv.err))
+	}
+	for _, c := range expected {
+		if !cv.seen[c] {
+			t.fails.WithLabelValues(gw.URL).Inc()
+			return res, res.Fail(task.Errorf(task.KindContentMismatch, "CAR from gateway is missing block %s: %s", c, url))
+		}
+	}
+
+	return res, nil
+}
+
+func (t *CarCheck) Registration() *task.Registration {
+	return t.reg
+}
+
+type carVerification struct {
+	// the blocks that were received and verified
+	seen map[string]bool
+	err  error
+}
+
+// verifyCar reads a CAR, checking that its root is the one we asked for
+// and that every block hashes to its CID.
+func verifyCar(r io.Reader, root cid.Cid) carVerification {
+	cv := carVerification{
+		seen: make(map[string]bool),
+	}
+	cr, err := car.NewReader(r)
+	if err != nil {
+		cv.err = err
+		return cv
+	}
+	if len(cr.Roots) != 1 || !cr.Roots[0].Equals(root) {
+		cv.err = fmt.Errorf("expected CAR root %s, got %v", root, cr.Roots)
+		return cv
+	}
+	for {
+		c, data, err := cr.Next()
+		if err == io.EOF {
+			return cv
+		}
+		if err != nil {
+			cv.err = err
+			return cv
+		}
+		sum, err := c.Prefix().Sum(data)
+		if err != nil {
+			cv.err = fmt.Errorf("failed to hash block %s: %w", c, err)
+			return cv
+		}
+		if !sum.Equals(c) {
+			cv.err = fmt.Errorf("block %s does not match its hash (got %s)", c, sum)
+			return cv
+		}
+		cv.seen[c.String()] = true
+	}
+}
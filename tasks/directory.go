@@ -0,0 +1,284 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	shell "github.com/ipfs/go-ipfs-api"
+	files "github.com/ipfs/go-ipfs-files"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/fetch"
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
+	"github.com/coryschwartz/gateway-monitor/pkg/verify"
+)
+
+const (
+	// DefaultDirectoryEntries is the number of entries in the
+	// listed directory of DirectoryCheck.
+	DefaultDirectoryEntries = 100
+
+	dirFileSize = 64 * kiB
+	// a name that has to be escaped in a URL
+	dirUnicodePath = "with space/héllo wörld ✓.txt"
+)
+
+// DirectoryCheck adds a directory tree to the local node and checks that
+// the gateway resolves paths within it, renders directory listings and
+// serves index.html files.
+type DirectoryCheck struct {
+	reg        *task.Registration
+	entries    int
+	start_time *prometheus.HistogramVec
+	fetch_time *prometheus.HistogramVec
+	fails      *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+}
+
+func NewDirectoryCheck(schedule string, entries int) *DirectoryCheck {
+	if entries <= 0 {
+		entries = DefaultDirectoryEntries
+	}
+	start_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "directory",
+			Name:      "latency",
+		},
+		[]string{"gateway", "check"},
+	)
+	fetch_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "directory",
+			Name:      "fetch_time",
+		},
+		[]string{"gateway", "check"},
+	)
+	fails := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "directory",
+			Name:      "fail_count",
+		},
+		[]string{"gateway"},
+	)
+	errors := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "directory",
+			Name:      "error_count",
+		},
+		[]string{"gateway"},
+	)
+	reg := task.Registration{
+		Name:     "directory",
+		Schedule: schedule,
+		Collectors: []prometheus.Collector{
+			start_time,
+			fetch_time,
+			fails,
+			errors,
+		},
+	}
+	return &DirectoryCheck{
+		reg:        &reg,
+		entries:    entries,
+		start_time: start_time,
+		fetch_time: fetch_time,
+		fails:      fails,
+		errors:     errors,
+	}
+}
+
+// dirCheck is one request made by DirectoryCheck.
+type dirCheck struct {
+	name string
+	// path relative to the root of the directory, unescaped
+	path    string
+	fetcher *fetch.Fetcher
+	check   func(res *task.Result, fr *fetch.Response, body []byte) error
+}
+
+func (t *DirectoryCheck) Run(ctx context.Context, sh *shell.Shell, ps *provider.Provider, gw gateway.Gateway) (*task.Result, error) {
+	res := task.NewResult()
+
+	// the file contents are generated from a seed so that every run
+	// adds a new directory
+	payload, err := NewPayload(dirFileSize, ShapeFile)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, err
+	}
+	log.Infow("generating directory", "entries", t.entries, "seed", payload.Seed)
+	res.Set("seed", strconv.FormatInt(payload.Seed, 10))
+	seeds := mrand.New(mrand.NewSource(payload.Seed))
+	nested := PayloadFile{Path: "sub/path/file", Size: dirFileSize, seed: seeds.Int63()}
+	unicode := PayloadFile{Path: dirUnicodePath, Size: dirFileSize, seed: seeds.Int63()}
+	index := []byte(fmt.Sprintf("<!DOCTYPE html>\n<html><body>gateway-monitor %d</body></html>\n", payload.Seed))
+
+	fls := map[string]files.Node{
+		nested.Path:       files.NewReaderFile(nested.Reader()),
+		unicode.Path:      files.NewReaderFile(unicode.Reader()),
+		"site/index.html": files.NewBytesFile(index),
+	}
+	names := make([]string, t.entries)
+	for i := range names {
+		names[i] = fmt.Sprintf("entry-%06d", i)
+		fls["many/"+names[i]] = files.NewBytesFile([]byte(names[i]))
+	}
+
+	// add to local ipfs
+	log.Info("writing directory to local IPFS node")
+	add_start := time.Now()
+	cidstr, err := addDirectory(ctx, sh, newDirectory(fls))
+	res.AddPhase("add", time.Since(add_start))
+	res.CID = cidstr
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, task.Errorf(task.KindLocalNode, "failed to write to IPFS: %w", err)
+	}
+	defer func() {
+		log.Info("cleaning up IPFS node")
+		err := sh.Unpin(cidstr)
+		if err != nil {
+			log.Warnw("failed to clean unpin cid.", "cid", cidstr)
+			t.errors.WithLabelValues(gw.URL).Inc()
+		}
+	}()
+
+	checks := []dirCheck{
+		{
+			// the first request is the one that has to find the content
+			name:    "nested_path",
+			path:    nested.Path,
+			fetcher: fetch.Default,
+			check:   checkDirFile(nested),
+		},
+		{
+			name:    "unicode_path",
+			path:    unicode.Path,
+			fetcher: fetch.Default,
+			check:   checkDirFile(unicode),
+		},
+		{
+			name:    "listing",
+			path:    "many/",
+			fetcher: fetch.Default,
+			check: func(res *task.Result, fr *fetch.Response, body []byte) error {
+				if err := checkStatus(fr, http.StatusOK); err != nil {
+					return err
+				}
+				if ct := fr.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+					return task.Errorf(task.KindHTTPStatus, "expected an HTML listing, got %q", ct)
+				}
+				for _, name := range names {
+					if !bytes.Contains(body, []byte(name)) {
+						return task.Errorf(task.KindContentMismatch, "listing is missing %s", name)
+					}
+				}
+				return nil
+			},
+		},
+		{
+			name:    "index_html",
+			path:    "site/",
+			fetcher: fetch.Default,
+			check: func(res *task.Result, fr *fetch.Response, body []byte) error {
+				if err := checkStatus(fr, http.StatusOK); err != nil {
+					return err
+				}
+				if !bytes.Equal(body, index) {
+					return task.Errorf(task.KindContentMismatch, "expected index.html to be served")
+				}
+				return nil
+			},
+		},
+		{
+			// directories are only served with a trailing slash,
+			// so that relative links in index.html work.
+			name:    "index_redirect",
+			path:    "site",
+			fetcher: fetch.NoRedirect,
+			check: func(res *task.Result, fr *fetch.Response, body []byte) error {
+				switch fr.StatusCode {
+				case http.StatusMovedPermanently, http.StatusFound,
+					http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+				default:
+					return task.Errorf(task.KindHTTPStatus, "expected a redirect, got status %d", fr.StatusCode)
+				}
+				if loc := fr.Header.Get("Location"); !strings.HasSuffix(loc, "/site/") {
+					return task.Errorf(task.KindHTTPStatus, "expected a redirect to the directory with a trailing slash, got %q", loc)
+				}
+				return nil
+			},
+		},
+	}
+
+	for i, c := range checks {
+		url := gw.Path("/ipfs/" + cidstr + "/" + escapePath(c.path))
+		log.Infow("fetching from gateway", "check", c.name, "url", url)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			t.errors.WithLabelValues(gw.URL).Inc()
+			return res, err
+		}
+		var buf bytes.Buffer
+		fr, err := c.fetcher.Do(req, &buf)
+		if i == 0 {
+			res.Set("url", url)
+			recordFetch(res, fr)
+		} else if fr != nil {
+			res.Bytes += fr.Size
+		}
+		if err != nil {
+			t.errors.WithLabelValues(gw.URL).Inc()
+			return res, task.Errorf(task.KindNetwork, "failed to fetch from gateway: %w", err)
+		}
+		t.start_time.WithLabelValues(gw.URL, c.name).Observe(float64(fr.TTFB.Milliseconds()))
+		t.fetch_time.WithLabelValues(gw.URL, c.name).Observe(float64(fr.Total.Milliseconds()))
+		res.AddPhase(c.name, fr.Total)
+
+		if err := c.check(res, fr, buf.Bytes()); err != nil {
+			t.fails.WithLabelValues(gw.URL).Inc()
+			return res, res.Fail(fmt.Errorf("%s check failed: %s: %w", c.name, url, err))
+		}
+	}
+
+	return res, nil
+}
+
+func (t *DirectoryCheck) Registration() *task.Registration {
+	return t.reg
+}
+
+// checkDirFile checks that a file of the directory was served.
+func checkDirFile(f PayloadFile) func(*task.Result, *fetch.Response, []byte) error {
+	return func(res *task.Result, fr *fetch.Response, body []byte) error {
+		if err := checkStatus(fr, http.StatusOK); err != nil {
+			return err
+		}
+		v := verify.NewReaderVerifier(f.Reader(), int64(f.Size))
+		v.Write(body)
+		return checkContent(res, v)
+	}
+}
+
+// escapePath escapes each segment of a slash separated path.
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
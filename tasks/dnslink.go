@@ -0,0 +1,264 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/ipfs/go-cid"
+	shell "github.com/ipfs/go-ipfs-api"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/fetch"
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
+)
+
+// DNSLink resolution modes of a gateway.
+const (
+	// /ipns/<domain> on the gateway.
+	DNSLinkPath = "path"
+	// The domain in the Host header, as when the domain is
+	// pointed at the gateway.
+	DNSLinkHost = "host"
+)
+
+// DNSLinkCheck resolves DNSLink domains through the gateway and compares
+// what it serves with what the local node resolves them to.
+type DNSLinkCheck struct {
+	reg                *task.Registration
+	domains            []string
+	modes              []string
+	resolve_time       *prometheus.HistogramVec
+	local_resolve_time *prometheus.HistogramVec
+	staleness          *prometheus.GaugeVec
+	stale              *prometheus.CounterVec
+	fails              *prometheus.CounterVec
+	errors             *prometheus.CounterVec
+
+	mu sync.Mutex
+	// what the local node resolved each domain to, and since when
+	local map[string]dnslinkValue
+}
+
+type dnslinkValue struct {
+	cid   cid.Cid
+	since time.Time
+}
+
+// NewDNSLinkCheck checks the domains in the given modes, DNSLinkPath and
+// DNSLinkHost. No modes means DNSLinkPath only.
+func NewDNSLinkCheck(schedule string, domains []string, modes ...string) *DNSLinkCheck {
+	if len(modes) == 0 {
+		modes = []string{DNSLinkPath}
+	}
+	resolve_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "dnslink",
+			Name:      "resolve_time",
+		},
+		[]string{"gateway", "domain", "mode"},
+	)
+	local_resolve_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "dnslink",
+			Name:      "local_resolve_time",
+		},
+		[]string{"domain"},
+	)
+	staleness := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "dnslink",
+			Name:      "staleness_seconds",
+		},
+		[]string{"gateway", "domain", "mode"},
+	)
+	stale := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "dnslink",
+			Name:      "stale_count",
+		},
+		[]string{"gateway", "domain", "mode"},
+	)
+	fails := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "dnslink",
+			Name:      "fail_count",
+		},
+		[]string{"gateway"},
+	)
+	errors := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "dnslink",
+			Name:      "error_count",
+		},
+		[]string{"gateway"},
+	)
+	reg := task.Registration{
+		Name:     "dnslink",
+		Schedule: schedule,
+		Collectors: []prometheus.Collector{
+			resolve_time,
+			local_resolve_time,
+			staleness,
+			stale,
+			fails,
+			errors,
+		},
+	}
+	return &DNSLinkCheck{
+		reg:                &reg,
+		domains:            domains,
+		modes:              modes,
+		resolve_time:       resolve_time,
+		local_resolve_time: local_resolve_time,
+		staleness:          staleness,
+		stale:              stale,
+		fails:              fails,
+		errors:             errors,
+		local:              make(map[string]dnslinkValue),
+	}
+}
+
+func (t *DNSLinkCheck) Run(ctx context.Context, sh *shell.Shell, ps *provider.Provider, gw gateway.Gateway) (*task.Result, error) {
+	res := task.NewResult()
+
+	// every domain is checked even if one fails
+	probs := newProblems(t.errors.WithLabelValues(gw.URL), t.fails.WithLabelValues(gw.URL))
+	for _, domain := range t.domains {
+		log.Infow("resolving DNSLink on local IPFS node", "domain", domain)
+		local, err := t.resolveLocal(sh, domain)
+		if err != nil {
+			probs.addErr(err, "%s: failed to resolve on local IPFS node: %s", domain, err)
+			continue
+		}
+		res.Set(domain+"_cid", local.cid.String())
+
+		for _, mode := range t.modes {
+			root, err := t.resolveGateway(ctx, res, gw, domain, mode, local.cid)
+			if err != nil {
+				probs.addErr(err, "%s (%s): %s", domain, mode, err)
+				continue
+			}
+			if root == cid.Undef {
+				probs.addFail(task.KindHTTPStatus, "%s (%s): gateway didn't resolve it", domain, mode)
+				continue
+			}
+			if !bytes.Equal(root.Hash(), local.cid.Hash()) {
+				staleness := time.Since(local.since)
+				log.Warnw("gateway serves stale DNSLink", "domain", domain, "mode", mode, "gateway_cid", root, "local_cid", local.cid, "staleness", staleness)
+				t.staleness.WithLabelValues(gw.URL, domain, mode).Set(staleness.Seconds())
+				t.stale.WithLabelValues(gw.URL, domain, mode).Inc()
+				probs.addFail(task.KindContentMismatch, "%s (%s): gateway serves %s instead of %s", domain, mode, root, local.cid)
+				continue
+			}
+			t.staleness.WithLabelValues(gw.URL, domain, mode).Set(0)
+		}
+	}
+
+	return res, probs.err(res, "failed to check DNSLink", "bad DNSLink resolution")
+}
+
+func (t *DNSLinkCheck) Registration() *task.Registration {
+	return t.reg
+}
+
+// resolveLocal resolves the domain to the CID its DNSLink points to,
+// remembering since when it has pointed there.
+func (t *DNSLinkCheck) resolveLocal(sh *shell.Shell, domain string) (dnslinkValue, error) {
+	start := time.Now()
+	resolved, err := sh.ResolvePath("/ipns/" + domain)
+	if err != nil {
+		return dnslinkValue{}, task.WrapError(task.KindLocalNode, err)
+	}
+	t.local_resolve_time.WithLabelValues(domain).Observe(float64(time.Since(start).Milliseconds()))
+	c, err := cid.Decode(resolved)
+	if err != nil {
+		return dnslinkValue{}, task.Errorf(task.KindLocalNode, "failed to decode cid after it was returned from IPFS: %w", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, ok := t.local[domain]
+	if !ok || !v.cid.Equals(c) {
+		// we can't tell when the record changed, only when we noticed
+		v = dnslinkValue{cid: c, since: start}
+		t.local[domain] = v
+	}
+	return v, nil
+}
+
+// resolveGateway requests the domain from the gateway and returns the CID
+// of the content it served, or cid.Undef if it didn't serve any. local is
+// what the local node resolved the domain to.
+func (t *DNSLinkCheck) resolveGateway(ctx context.Context, res *task.Result, gw gateway.Gateway, domain, mode string, local cid.Cid) (cid.Cid, error) {
+	fr, err := t.request(ctx, gw, domain, mode, "", "", nil)
+	if fr != nil {
+		res.Bytes += fr.Size
+	}
+	if err != nil {
+		return cid.Undef, err
+	}
+	log.Infow("gateway resolved DNSLink", "domain", domain, "mode", mode, "status", fr.StatusCode, "ms", fr.Total.Milliseconds())
+	t.resolve_time.WithLabelValues(gw.URL, domain, mode).Observe(float64(fr.Total.Milliseconds()))
+	res.AddPhase(domain+"_"+mode, fr.Total)
+	if fr.StatusCode != http.StatusOK {
+		return cid.Undef, nil
+	}
+
+	// the CIDs of the path are listed in X-Ipfs-Roots, the last one
+	// being what the path resolved to.
+	if roots := fr.Header.Get("X-Ipfs-Roots"); roots != "" {
+		parts := strings.Split(roots, ",")
+		c, err := cid.Decode(strings.TrimSpace(parts[len(parts)-1]))
+		if err != nil {
+			return cid.Undef, task.Errorf(task.KindHTTPStatus, "invalid X-Ipfs-Roots %q: %w", roots, err)
+		}
+		return c, nil
+	}
+
+	// without the header, ask for the block itself and hash it the way
+	// the local node did.
+	var block bytes.Buffer
+	fr, err = t.request(ctx, gw, domain, mode, "?format=raw", "application/vnd.ipld.raw", &block)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if fr.StatusCode != http.StatusOK {
+		return cid.Undef, task.Errorf(task.KindHTTPStatus, "gateway sent no X-Ipfs-Roots and can't serve the raw block (status %d)", fr.StatusCode)
+	}
+	return local.Prefix().Sum(block.Bytes())
+}
+
+// request requests the domain from the gateway in the given mode.
+func (t *DNSLinkCheck) request(ctx context.Context, gw gateway.Gateway, domain, mode, query, accept string, w io.Writer) (*fetch.Response, error) {
+	url := gw.Path("/ipns/" + domain + query)
+	if mode == DNSLinkHost {
+		url = gw.URL + "/" + query
+	}
+	log.Infow("fetching from gateway", "url", url, "domain", domain, "mode", mode)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if mode == DNSLinkHost {
+		req.Host = domain
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	fr, err := fetch.Default.Do(req, w)
+	return fr, task.WrapError(task.KindNetwork, err)
+}
@@ -0,0 +1,84 @@
+package tasks
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/ipfs/go-cid"
+	shell "github.com/ipfs/go-ipfs-api"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/fetch"
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
+)
+
+// recordFetch adds what was observed while fetching from a gateway
+// to the task result. Phases that didn't happen are left out.
+func recordFetch(res *task.Result, fr *fetch.Response) {
+	if fr == nil {
+		return
+	}
+	res.HTTPStatus = fr.StatusCode
+	res.Bytes += fr.Size
+	for _, p := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"dns", fr.DNS},
+		{"connect", fr.Connect},
+		{"tls", fr.TLS},
+		{"ttfb", fr.TTFB},
+		{"transfer", fr.Transfer},
+		{"fetch", fr.Total},
+	} {
+		if p.d > 0 {
+			res.AddPhase(p.name, p.d)
+		}
+	}
+}
+
+// addPayload writes payload to the local IPFS node, recording the time it
+// took and its CID in the result. The returned function unpins it again.
+// Failing to add or unpin it is counted in errs.
+func addPayload(res *task.Result, sh *shell.Shell, payload *Payload, errs prometheus.Counter) (cid.Cid, func(), error) {
+	log.Info("writing data to local IPFS node")
+	add_start := time.Now()
+	cidstr, err := sh.Add(payload.Reader())
+	res.AddPhase("add", time.Since(add_start))
+	res.CID = cidstr
+	if err != nil {
+		errs.Inc()
+		return cid.Undef, nil, task.Errorf(task.KindLocalNode, "failed to write to IPFS: %w", err)
+	}
+	unpin := func() {
+		log.Info("cleaning up IPFS node")
+		if err := sh.Unpin(cidstr); err != nil {
+			log.Warnw("failed to clean unpin cid.", "cid", cidstr)
+			errs.Inc()
+		}
+	}
+	root, err := cid.Decode(cidstr)
+	if err != nil {
+		unpin()
+		errs.Inc()
+		return cid.Undef, nil, task.Errorf(task.KindLocalNode, "failed to decode cid after it was returned from IPFS: %w", err)
+	}
+	return root, unpin, nil
+}
+
+// cacheMaxAge returns the max-age directive of the Cache-Control header.
+func cacheMaxAge(h http.Header) (int, bool) {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		if age, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+			return age, true
+		}
+	}
+	return 0, false
+}
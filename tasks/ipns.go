@@ -1,123 +1,190 @@
 package tasks
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"net/http/httptrace"
-	"reflect"
+	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 
 	shell "github.com/ipfs/go-ipfs-api"
-	pinning "github.com/ipfs/go-pinning-service-http-client"
 
+	"github.com/coryschwartz/gateway-monitor/pkg/fetch"
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
 	"github.com/coryschwartz/gateway-monitor/pkg/task"
+	"github.com/coryschwartz/gateway-monitor/pkg/verify"
 )
 
+// IpnsStage is the step of IpnsBench that failed.
+type IpnsStage string
+
+const (
+	IpnsKeygen   IpnsStage = "keygen"
+	IpnsPublish  IpnsStage = "publish"
+	IpnsResolve  IpnsStage = "resolve"
+	IpnsFetch    IpnsStage = "fetch"
+	IpnsMismatch IpnsStage = "mismatch"
+)
+
+// IpnsError is returned by IpnsBench when a run fails.
+type IpnsError struct {
+	Stage IpnsStage
+	Err   error
+}
+
+func (e *IpnsError) Error() string {
+	return fmt.Sprintf("ipns %s failed: %v", e.Stage, e.Err)
+}
+
+func (e *IpnsError) Unwrap() error {
+	return e.Err
+}
+
 type IpnsBench struct {
 	reg          *task.Registration
 	size         int
-	publish_time prometheus.Histogram
-	start_time   prometheus.Histogram
-	fetch_time   prometheus.Histogram
-	fails        prometheus.Counter
-	errors       prometheus.Counter
+	publish_time *prometheus.HistogramVec
+	resolve_time *prometheus.HistogramVec
+	start_time   *prometheus.HistogramVec
+	fetch_time   *prometheus.HistogramVec
+	fails        *prometheus.CounterVec
+	errors       *prometheus.CounterVec
+	failures     *prometheus.CounterVec
 }
 
 func NewIpnsBench(schedule string, size int) *IpnsBench {
-	publish_time := prometheus.NewHistogram(
+	publish_time := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "ipns",
 			Name:      "publish",
-		})
-	start_time := prometheus.NewHistogram(
+		},
+		[]string{"gateway"},
+	)
+	resolve_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "ipns",
+			Name:      "resolve",
+		},
+		[]string{"gateway"},
+	)
+	start_time := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "ipns",
 			Name:      fmt.Sprintf("%d_latency", size),
-		})
-	fetch_time := prometheus.NewHistogram(
+		},
+		[]string{"gateway"},
+	)
+	fetch_time := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "ipns",
 			Name:      fmt.Sprintf("%d_fetch_time", size),
-		})
-	fails := prometheus.NewCounter(
+		},
+		[]string{"gateway"},
+	)
+	fails := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "ipns",
 			Name:      "fail_count",
-		})
-	errors := prometheus.NewCounter(
+		},
+		[]string{"gateway"},
+	)
+	errors := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "ipns",
 			Name:      "error_count",
-		})
+		},
+		[]string{"gateway"},
+	)
+	failures := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "ipns",
+			Name:      "failure_count",
+		},
+		[]string{"gateway", "stage"},
+	)
 	reg := task.Registration{
+		Name:     fmt.Sprintf("ipns_%d", size),
 		Schedule: schedule,
+		Group:    BandwidthGroup,
 		Collectors: []prometheus.Collector{
 			publish_time,
+			resolve_time,
 			start_time,
 			fetch_time,
 			fails,
 			errors,
+			failures,
 		},
 	}
 	return &IpnsBench{
 		reg:          &reg,
 		size:         size,
 		publish_time: publish_time,
+		resolve_time: resolve_time,
 		start_time:   start_time,
 		fetch_time:   fetch_time,
 		fails:        fails,
 		errors:       errors,
+		failures:     failures,
 	}
 }
 
-func (t *IpnsBench) Run(ctx context.Context, sh *shell.Shell, ps *pinning.Client, gw string) error {
+func (t *IpnsBench) Run(ctx context.Context, sh *shell.Shell, ps *provider.Provider, gw gateway.Gateway) (*task.Result, error) {
+	res := task.NewResult()
 
-	// generate random data
-	log.Infof("generating %d bytes random data", t.size)
-	randb := make([]byte, t.size)
-	if _, err := rand.Read(randb); err != nil {
-		t.errors.Inc()
-		return fmt.Errorf("failed to generate random values: %w", err)
+	// generate random data from a seed, so it can be regenerated
+	// to verify the response, and reproduced later with `replay`.
+	payload, err := NewPayload(t.size, ShapeFile)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, err
 	}
-	buf := bytes.NewReader(randb)
+	log.Infow("generating random data", "bytes", t.size, "seed", payload.Seed)
+	res.Set("seed", strconv.FormatInt(payload.Seed, 10))
 
 	// add to local ipfs
 	log.Info("writing data to local IPFS node")
-	cidstr, err := sh.Add(buf)
+	add_start := time.Now()
+	cidstr, err := sh.Add(payload.Reader())
+	res.AddPhase("add", time.Since(add_start))
+	res.CID = cidstr
 	if err != nil {
 		log.Errorw("failed to write to IPFS", "err", err)
-		t.errors.Inc()
-		return err
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, task.WrapError(task.KindLocalNode, err)
 	}
 	defer func() {
 		log.Info("cleaning up IPFS node")
 		err := sh.Unpin(cidstr)
 		if err != nil {
-			t.errors.Inc()
+			t.errors.WithLabelValues(gw.URL).Inc()
 			log.Warnw("failed to clean unpin cid.", "cid", cidstr)
 		}
 	}()
 
-	// Generate a new key
-	// we already have a random value lying around, might as
-	// well use it for the ney name.
-	keyName := base64.StdEncoding.EncodeToString(randb[:8])
+	// Generate a new key with a random name
+	keyb := make([]byte, 8)
+	if _, err := rand.Read(keyb); err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, fmt.Errorf("failed to generate key name: %w", err)
+	}
+	keyName := base64.StdEncoding.EncodeToString(keyb)
 	_, err = sh.KeyGen(ctx, keyName)
 	if err != nil {
-		t.errors.Inc()
-		return fmt.Errorf("failed to generate new key: %w", err)
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, t.fail(res, gw, IpnsKeygen, task.Errorf(task.KindLocalNode, "failed to generate new key: %w", err))
 	}
 	defer func() {
 		sh.KeyRm(ctx, keyName)
@@ -126,53 +193,74 @@ func (t *IpnsBench) Run(ctx context.Context, sh *shell.Shell, ps *pinning.Client
 	// Publish IPNS
 	pub_start := time.Now()
 	pubResp, err := sh.PublishWithDetails(cidstr, keyName, time.Hour, time.Hour, true)
+	res.AddPhase("publish", time.Since(pub_start))
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, t.fail(res, gw, IpnsPublish, task.Errorf(task.KindLocalNode, "failed to publish IPNS: %w", err))
+	}
 	publish_time := time.Since(pub_start).Milliseconds()
 	log.Infow("published IPNS", "ms", publish_time, "cid", cidstr, "ipns", pubResp.Name)
-	t.publish_time.Observe(float64(publish_time))
+	t.publish_time.WithLabelValues(gw.URL).Observe(float64(publish_time))
+
+	// resolve the name before asking the gateway, so that a record that
+	// doesn't resolve isn't taken for a gateway failure
+	res.Set("ipns", pubResp.Name)
+	resolve_start := time.Now()
+	resolved, err := sh.Resolve(pubResp.Name)
+	resolve_time := time.Since(resolve_start)
+	res.AddPhase("resolve", resolve_time)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, t.fail(res, gw, IpnsResolve, task.Errorf(task.KindLocalNode, "failed to resolve IPNS: %w", err))
+	}
+	log.Infow("resolved IPNS", "ms", resolve_time.Milliseconds(), "ipns", pubResp.Name, "path", resolved)
+	t.resolve_time.WithLabelValues(gw.URL).Observe(float64(resolve_time.Milliseconds()))
+	if resolved != "/ipfs/"+cidstr {
+		t.fails.WithLabelValues(gw.URL).Inc()
+		return res, res.Fail(t.fail(res, gw, IpnsResolve, task.Errorf(task.KindContentMismatch, "expected %s to resolve to /ipfs/%s, got %s", pubResp.Name, cidstr, resolved)))
+	}
 
 	// request from gateway, observing client metrics
-	url := fmt.Sprintf("%s/ipns/%s", gw, pubResp.Name)
+	url := gw.Path("/ipns/" + pubResp.Name)
 	log.Infow("fetching from gateway", "url", url)
-	req, _ := http.NewRequest("GET", url, nil)
-	start := time.Now()
-	var firstbyte_time time.Time
-	trace := &httptrace.ClientTrace{
-		GotFirstResponseByte: func() {
-			latency := time.Since(start).Milliseconds()
-			log.Infow("first byte received", "ms", latency)
-			t.start_time.Observe(float64(latency))
-			common_fetch_latency.Set(float64(latency))
-			firstbyte_time = time.Now()
-		},
+	res.Set("url", url)
+	v := verify.NewReaderVerifier(payload.Reader(), int64(t.size))
+	fr, err := fetch.Get(ctx, url, v)
+	recordFetch(res, fr)
+	if fr != nil && fr.TTFB > 0 {
+		log.Infow("first byte received", "ms", fr.TTFB.Milliseconds())
+		t.start_time.WithLabelValues(gw.URL).Observe(float64(fr.TTFB.Milliseconds()))
+		common_fetch_latency.WithLabelValues(gw.URL, "").Set(float64(fr.TTFB.Milliseconds()))
 	}
-	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
-	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		t.errors.Inc()
-		return fmt.Errorf("failed to fetch from gateway: %w", err)
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, t.fail(res, gw, IpnsFetch, task.Errorf(task.KindNetwork, "failed to fetch from gateway: %w", err))
 	}
-	respb, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		t.errors.Inc()
-		return fmt.Errorf("failed to download content: %w", err)
-	}
-	total_time := time.Since(start).Milliseconds()
-	download_time := time.Since(firstbyte_time).Seconds()
-	log.Infow("finished download", "ms", total_time)
-	t.fetch_time.Observe(float64(total_time))
-	downloadBytesPerSecond := float64(t.size) / download_time
-	common_fetch_speed.Set(downloadBytesPerSecond)
+	log.Infow("finished download", "ms", fr.Total.Milliseconds())
+	t.fetch_time.WithLabelValues(gw.URL).Observe(float64(fr.Total.Milliseconds()))
+	common_fetch_speed.WithLabelValues(gw.URL, "").Set(fr.BytesPerSecond())
 
 	log.Info("checking result")
+	if err := checkStatus(fr, http.StatusOK); err != nil {
+		t.fails.WithLabelValues(gw.URL).Inc()
+		return res, res.Fail(t.fail(res, gw, IpnsFetch, fmt.Errorf("failed to fetch from gateway: %s: %w", url, err)))
+	}
 	// compare response with what we sent
-	if !reflect.DeepEqual(respb, randb) {
-		t.fails.Inc()
-		return fmt.Errorf("expected response from gateway to match generated content: %w", err)
+	if err := checkContent(res, v); err != nil {
+		t.fails.WithLabelValues(gw.URL).Inc()
+		return res, res.Fail(t.fail(res, gw, IpnsMismatch, fmt.Errorf("expected response from gateway to match generated content: %s: %w", url, err)))
 	}
 
-	return nil
+	return res, nil
 }
 
 func (t *IpnsBench) Registration() *task.Registration {
 	return t.reg
 }
+
+// fail records the stage at which the run failed.
+func (t *IpnsBench) fail(res *task.Result, gw gateway.Gateway, stage IpnsStage, err error) error {
+	t.failures.WithLabelValues(gw.URL, string(stage)).Inc()
+	res.Set("stage", string(stage))
+	return &IpnsError{Stage: stage, Err: err}
+}
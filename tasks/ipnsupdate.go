@@ -0,0 +1,296 @@
+package tasks
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	shell "github.com/ipfs/go-ipfs-api"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/fetch"
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
+	"github.com/coryschwartz/gateway-monitor/pkg/verify"
+)
+
+const (
+	// DefaultIpnsUpdateKey is the name of the keys IpnsUpdateBench
+	// keeps on the local node.
+	DefaultIpnsUpdateKey = "gateway-monitor-ipns-update"
+	// DefaultIpnsUpdateTTL is the TTL of the records IpnsUpdateBench
+	// publishes. Gateways may cache the record for this long.
+	DefaultIpnsUpdateTTL = time.Minute
+
+	ipnsUpdateSize     = 1 * kiB
+	ipnsUpdateInterval = 5 * time.Second
+	ipnsUpdateLifetime = 24 * time.Hour
+)
+
+// IpnsUpdateBench measures how long it takes for an update of an IPNS name
+// to be served by the gateway. It keeps a key on the local node, publishes
+// new content to it on every run and polls the gateway until it serves it.
+type IpnsUpdateBench struct {
+	reg              *task.Registration
+	key              string
+	ttl              time.Duration
+	publish_time     *prometheus.HistogramVec
+	propagation_time *prometheus.HistogramVec
+	stale            *prometheus.CounterVec
+	max_age          *prometheus.GaugeVec
+	fails            *prometheus.CounterVec
+	errors           *prometheus.CounterVec
+
+	mu sync.Mutex
+	// the content each key was last published to, to be unpinned
+	// once it has been replaced. Keys missing from it are resolved,
+	// as their content may be left from before a restart.
+	published map[string]string
+}
+
+func NewIpnsUpdateBench(schedule string, key string, ttl time.Duration) *IpnsUpdateBench {
+	publish_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "ipns_update",
+			Name:      "publish",
+		},
+		[]string{"gateway"},
+	)
+	propagation_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "ipns_update",
+			Name:      "propagation_seconds",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		},
+		[]string{"gateway"},
+	)
+	stale := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "ipns_update",
+			Name:      "stale_count",
+		},
+		[]string{"gateway"},
+	)
+	max_age := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "ipns_update",
+			Name:      "cache_max_age_seconds",
+		},
+		[]string{"gateway"},
+	)
+	fails := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "ipns_update",
+			Name:      "fail_count",
+		},
+		[]string{"gateway"},
+	)
+	errors := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "ipns_update",
+			Name:      "error_count",
+		},
+		[]string{"gateway"},
+	)
+	reg := task.Registration{
+		Name:     "ipns_update",
+		Schedule: schedule,
+		Collectors: []prometheus.Collector{
+			publish_time,
+			propagation_time,
+			stale,
+			max_age,
+			fails,
+			errors,
+		},
+	}
+	return &IpnsUpdateBench{
+		reg:              &reg,
+		key:              key,
+		ttl:              ttl,
+		publish_time:     publish_time,
+		propagation_time: propagation_time,
+		stale:            stale,
+		max_age:          max_age,
+		fails:            fails,
+		errors:           errors,
+		published:        make(map[string]string),
+	}
+}
+
+func (t *IpnsUpdateBench) Run(ctx context.Context, sh *shell.Shell, ps *provider.Provider, gw gateway.Gateway) (*task.Result, error) {
+	res := task.NewResult()
+
+	// every gateway gets its own key, so that runs against different
+	// gateways don't update each other's names.
+	gwhash := sha256.Sum256([]byte(gw.URL))
+	keyName := fmt.Sprintf("%s-%x", t.key, gwhash[:4])
+	key, err := t.getKey(ctx, sh, keyName)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, err
+	}
+	res.Set("ipns", key.Id)
+	res.Set("ttl", t.ttl.String())
+
+	payload, err := NewPayload(ipnsUpdateSize, ShapeFile)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, err
+	}
+	log.Infow("generating random data", "bytes", ipnsUpdateSize, "seed", payload.Seed)
+	res.Set("seed", strconv.FormatInt(payload.Seed, 10))
+
+	// add to local ipfs
+	root, unpin, err := addPayload(res, sh, payload, t.errors.WithLabelValues(gw.URL))
+	if err != nil {
+		return res, err
+	}
+	cidstr := root.String()
+	t.resolvePublished(sh, keyName, key.Id)
+
+	// update the name
+	pub_start := time.Now()
+	_, err = sh.PublishWithDetails(cidstr, keyName, ipnsUpdateLifetime, t.ttl, true)
+	publish_time := time.Since(pub_start)
+	res.AddPhase("publish", publish_time)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		unpin()
+		return res, task.Errorf(task.KindLocalNode, "failed to publish IPNS: %w", err)
+	}
+	log.Infow("published IPNS", "ms", publish_time.Milliseconds(), "cid", cidstr, "ipns", key.Id)
+	t.publish_time.WithLabelValues(gw.URL).Observe(float64(publish_time.Milliseconds()))
+	published := time.Now()
+	t.replace(sh, gw, keyName, cidstr)
+
+	// poll the gateway until it serves the new content
+	url := gw.Path("/ipns/" + key.Id)
+	res.Set("url", url)
+	stale := 0
+	for i := 0; ; i++ {
+		log.Infow("fetching from gateway", "url", url, "attempt", i)
+		v := verify.NewReaderVerifier(payload.Reader(), ipnsUpdateSize)
+		fr, err := fetch.Get(ctx, url, v)
+		if i == 0 {
+			recordFetch(res, fr)
+			if fr != nil && fr.Header != nil {
+				recordCaching(res, "first_", fr.Header)
+			}
+		} else if fr != nil {
+			res.Bytes += fr.Size
+		}
+		switch {
+		case err != nil && ctx.Err() == nil:
+			t.errors.WithLabelValues(gw.URL).Inc()
+			return res, task.Errorf(task.KindNetwork, "failed to fetch from gateway: %w", err)
+		case err == nil && fr.StatusCode == http.StatusOK && v.Verify() == nil:
+			propagation := time.Since(published)
+			log.Infow("gateway serves the update", "seconds", propagation.Seconds(), "stale", stale)
+			t.propagation_time.WithLabelValues(gw.URL).Observe(propagation.Seconds())
+			res.AddPhase("propagation", propagation)
+			res.Set("stale", strconv.Itoa(stale))
+			if age, ok := recordCaching(res, "", fr.Header); ok {
+				t.max_age.WithLabelValues(gw.URL).Set(float64(age))
+			}
+			return res, nil
+		case err == nil && fr.StatusCode == http.StatusOK:
+			// the previous value, or something else entirely
+			stale++
+			t.stale.WithLabelValues(gw.URL).Inc()
+		}
+
+		select {
+		case <-time.After(ipnsUpdateInterval):
+		case <-ctx.Done():
+			res.Set("stale", strconv.Itoa(stale))
+			t.fails.WithLabelValues(gw.URL).Inc()
+			return res, res.Fail(task.Errorf(task.KindTimeout, "gateway didn't serve the update within %s (%d stale responses): %s",
+				time.Since(published).Round(time.Second), stale, url))
+		}
+	}
+}
+
+func (t *IpnsUpdateBench) Registration() *task.Registration {
+	return t.reg
+}
+
+// getKey returns the key with the given name, creating it if the local
+// node doesn't have it yet.
+func (t *IpnsUpdateBench) getKey(ctx context.Context, sh *shell.Shell, name string) (*shell.Key, error) {
+	keys, err := sh.KeyList(ctx)
+	if err != nil {
+		return nil, task.Errorf(task.KindLocalNode, "failed to list keys: %w", err)
+	}
+	for _, k := range keys {
+		if k.Name == name {
+			return k, nil
+		}
+	}
+	log.Infow("generating IPNS key", "name", name)
+	key, err := sh.KeyGen(ctx, name)
+	if err != nil {
+		return nil, task.Errorf(task.KindLocalNode, "failed to generate new key: %w", err)
+	}
+	return key, nil
+}
+
+// resolvePublished looks up the content keyName was published to if this
+// process hasn't published it yet, so that replace unpins it. A key that
+// was never published doesn't resolve.
+func (t *IpnsUpdateBench) resolvePublished(sh *shell.Shell, keyName, id string) {
+	t.mu.Lock()
+	_, ok := t.published[keyName]
+	t.mu.Unlock()
+	if ok {
+		return
+	}
+	resolved, err := sh.Resolve(id)
+	if err != nil {
+		log.Infow("IPNS key doesn't resolve, nothing to clean up", "ipns", id, "err", err)
+		resolved = ""
+	}
+	t.mu.Lock()
+	t.published[keyName] = strings.TrimPrefix(resolved, "/ipfs/")
+	t.mu.Unlock()
+}
+
+// replace unpins the content the key was published to before.
+func (t *IpnsUpdateBench) replace(sh *shell.Shell, gw gateway.Gateway, keyName, cidstr string) {
+	t.mu.Lock()
+	old := t.published[keyName]
+	t.published[keyName] = cidstr
+	t.mu.Unlock()
+	if old == "" || old == cidstr {
+		return
+	}
+	log.Info("cleaning up IPFS node")
+	if err := sh.Unpin(old); err != nil {
+		log.Warnw("failed to clean unpin cid.", "cid", old)
+		t.errors.WithLabelValues(gw.URL).Inc()
+	}
+}
+
+// recordCaching records the Cache-Control header of a response, prefixed
+// with prefix, and returns its max-age if it has one.
+func recordCaching(res *task.Result, prefix string, h http.Header) (int, bool) {
+	cc := h.Get("Cache-Control")
+	if cc == "" {
+		return 0, false
+	}
+	res.Set(prefix+"cache_control", cc)
+	return cacheMaxAge(h)
+}
@@ -1,57 +1,66 @@
 package tasks
 
 import (
+	"bytes"
 	"context"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"net/http/httptrace"
-	"reflect"
-	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 
 	shell "github.com/ipfs/go-ipfs-api"
-	pinning "github.com/ipfs/go-pinning-service-http-client"
 
+	"github.com/coryschwartz/gateway-monitor/pkg/fetch"
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
 	"github.com/coryschwartz/gateway-monitor/pkg/task"
+	"github.com/coryschwartz/gateway-monitor/pkg/verify"
 )
 
 type KnownGoodCheck struct {
 	reg        *task.Registration
 	checks     map[string][]byte
-	start_time prometheus.Histogram
-	fetch_time prometheus.Histogram
-	fails      prometheus.Counter
-	errors     prometheus.Counter
+	start_time *prometheus.HistogramVec
+	fetch_time *prometheus.HistogramVec
+	fails      *prometheus.CounterVec
+	errors     *prometheus.CounterVec
 }
 
 func NewKnownGoodCheck(schedule string, checks map[string][]byte) *KnownGoodCheck {
-	start_time := prometheus.NewHistogram(
+	start_time := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "known_good",
 			Name:      "latency",
-		})
-	fetch_time := prometheus.NewHistogram(
+		},
+		[]string{"gateway"},
+	)
+	fetch_time := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "known_good",
 			Name:      "fetch_time",
-		})
-	fails := prometheus.NewCounter(
+		},
+		[]string{"gateway"},
+	)
+	fails := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "known_good",
 			Name:      "fail_count",
-		})
-	errors := prometheus.NewCounter(
+		},
+		[]string{"gateway"},
+	)
+	errors := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "known_good",
 			Name:      "error_count",
-		})
+		},
+		[]string{"gateway"},
+	)
 	reg := task.Registration{
+		Name:     "known_good",
 		Schedule: schedule,
 		Collectors: []prometheus.Collector{
 			start_time,
@@ -70,46 +79,41 @@ func NewKnownGoodCheck(schedule string, checks map[string][]byte) *KnownGoodChec
 	}
 }
 
-func (t *KnownGoodCheck) Run(ctx context.Context, sh *shell.Shell, ps *pinning.Client, gw string) error {
+func (t *KnownGoodCheck) Run(ctx context.Context, sh *shell.Shell, ps *provider.Provider, gw gateway.Gateway) (*task.Result, error) {
+	res := task.NewResult()
 
 	for ipfspath, value := range t.checks {
 		// request from gateway, observing client metrics
-		url := fmt.Sprintf("%s%s", gw, ipfspath)
+		url := gw.Path(ipfspath)
 		log.Infow("fetching from gateway", "url", url)
-		req, _ := http.NewRequest("GET", url, nil)
-		start := time.Now()
-		trace := &httptrace.ClientTrace{
-			GotFirstResponseByte: func() {
-				latency := time.Since(start).Milliseconds()
-				log.Infow("first byte received", "ms", latency)
-				t.start_time.Observe(float64(latency))
-			},
+		res.Set("url", url)
+		v := verify.NewReaderVerifier(bytes.NewReader(value), int64(len(value)))
+		fr, err := fetch.Get(ctx, url, v)
+		recordFetch(res, fr)
+		if fr != nil && fr.TTFB > 0 {
+			log.Infow("first byte received", "ms", fr.TTFB.Milliseconds())
+			t.start_time.WithLabelValues(gw.URL).Observe(float64(fr.TTFB.Milliseconds()))
 		}
-		req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
-		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
-			t.errors.Inc()
-			return fmt.Errorf("failed to fetch from gateway: %w", err)
+			t.errors.WithLabelValues(gw.URL).Inc()
+			return res, task.Errorf(task.KindNetwork, "failed to fetch from gateway: %w", err)
 		}
-		respb, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			t.errors.Inc()
-			return fmt.Errorf("failed to download content: %w", err)
-		}
-		total_time := time.Since(start).Milliseconds()
-		log.Infow("finished download", "ms", total_time)
-		t.errors.Inc()
-		t.fetch_time.Observe(float64(total_time))
+		log.Infow("finished download", "ms", fr.Total.Milliseconds())
+		t.fetch_time.WithLabelValues(gw.URL).Observe(float64(fr.Total.Milliseconds()))
 
 		log.Info("checking result")
+		if err := checkStatus(fr, http.StatusOK); err != nil {
+			t.fails.WithLabelValues(gw.URL).Inc()
+			return res, res.Fail(fmt.Errorf("failed to fetch known content from gateway: %s: %w", url, err))
+		}
 		// compare response with what we sent
-		if !reflect.DeepEqual(respb, value) {
-			t.fails.Inc()
-			return fmt.Errorf("expected response from gateway to match generated content: %s", url)
+		if err := checkContent(res, v); err != nil {
+			t.fails.WithLabelValues(gw.URL).Inc()
+			return res, res.Fail(fmt.Errorf("expected response from gateway to match known content: %s: %w", url, err))
 		}
 	}
 
-	return nil
+	return res, nil
 }
 
 func (t *KnownGoodCheck) Registration() *task.Registration {
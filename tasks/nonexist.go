@@ -4,55 +4,62 @@ import (
 	"context"
 	"crypto/rand"
 	"fmt"
-	"io/ioutil"
-	"net/http"
-	"net/http/httptrace"
-	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/ipfs/go-cid"
 	shell "github.com/ipfs/go-ipfs-api"
-	pinning "github.com/ipfs/go-pinning-service-http-client"
 	"github.com/multiformats/go-multihash"
 
+	"github.com/coryschwartz/gateway-monitor/pkg/fetch"
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
 	"github.com/coryschwartz/gateway-monitor/pkg/task"
 )
 
 type NonExistCheck struct {
 	reg        *task.Registration
-	start_time prometheus.Histogram
-	fetch_time prometheus.Histogram
-	fails      prometheus.Counter
-	errors     prometheus.Counter
+	start_time *prometheus.HistogramVec
+	fetch_time *prometheus.HistogramVec
+	fails      *prometheus.CounterVec
+	errors     *prometheus.CounterVec
 }
 
 func NewNonExistCheck(schedule string) *NonExistCheck {
-	start_time := prometheus.NewHistogram(
+	start_time := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "nonexsist",
 			Name:      "latency",
-		})
-	fetch_time := prometheus.NewHistogram(
+		},
+		[]string{"gateway"},
+	)
+	fetch_time := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "non_exist",
 			Name:      "fetch_time",
-		})
-	fails := prometheus.NewCounter(
+		},
+		[]string{"gateway"},
+	)
+	fails := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "non_exist",
 			Name:      "fail_count",
-		})
-	errors := prometheus.NewCounter(
+		},
+		[]string{"gateway"},
+	)
+	errors := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "non_exist",
 			Name:      "error_count",
-		})
+		},
+		[]string{"gateway"},
+	)
 	reg := task.Registration{
+		Name:     "non_exist",
 		Schedule: schedule,
 		Collectors: []prometheus.Collector{
 			start_time,
@@ -70,63 +77,55 @@ func NewNonExistCheck(schedule string) *NonExistCheck {
 	}
 }
 
-func (t *NonExistCheck) Run(ctx context.Context, sh *shell.Shell, ps *pinning.Client, gw string) error {
+func (t *NonExistCheck) Run(ctx context.Context, sh *shell.Shell, ps *provider.Provider, gw gateway.Gateway) (*task.Result, error) {
+	res := task.NewResult()
 
 	buf := make([]byte, 128)
 	_, err := rand.Read(buf)
 	if err != nil {
-		t.errors.Inc()
-		return fmt.Errorf("failed to generate random bytes: %w", err)
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, fmt.Errorf("failed to generate random bytes: %w", err)
 	}
 
 	encoded, err := multihash.EncodeName(buf, "sha3")
 	if err != nil {
-		t.errors.Inc()
-		return fmt.Errorf("failed to generate multihash of random bytes: %w", err)
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, fmt.Errorf("failed to generate multihash of random bytes: %w", err)
 	}
 	cast, err := multihash.Cast(encoded)
 	if err != nil {
-		t.errors.Inc()
-		return fmt.Errorf("failed to cast as multihash: %w", err)
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, fmt.Errorf("failed to cast as multihash: %w", err)
 	}
 
 	c := cid.NewCidV1(cid.Raw, cast)
 	log.Info("generated random CID", "cid", c.String())
+	res.CID = c.String()
 
-	url := fmt.Sprintf("%s/ipfs/%s", gw, c.String())
+	url := gw.Path("/ipfs/" + c.String())
 
 	log.Infow("fetching from gateway", "url", url)
-	req, _ := http.NewRequest("GET", url, nil)
-	start := time.Now()
-	trace := &httptrace.ClientTrace{
-		GotFirstResponseByte: func() {
-			latency := time.Since(start).Milliseconds()
-			log.Infow("first byte received", "ms", latency)
-			t.start_time.Observe(float64(latency))
-		},
-	}
-	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		t.errors.Inc()
-		return fmt.Errorf("failed to fetch from gateway: %w", err)
+	res.Set("url", url)
+	fr, err := fetch.Get(ctx, url, nil)
+	recordFetch(res, fr)
+	if fr != nil && fr.TTFB > 0 {
+		log.Infow("first byte received", "ms", fr.TTFB.Milliseconds())
+		t.start_time.WithLabelValues(gw.URL).Observe(float64(fr.TTFB.Milliseconds()))
 	}
-	_, err = ioutil.ReadAll(resp.Body)
 	if err != nil {
-		t.errors.Inc()
-		return fmt.Errorf("failed to download content: %w", err)
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, task.Errorf(task.KindNetwork, "failed to fetch from gateway: %w", err)
 	}
-	total_time := time.Since(start).Milliseconds()
-	log.Infow("finished download", "ms", total_time)
-	t.fetch_time.Observe(float64(total_time))
+	log.Infow("finished download", "ms", fr.Total.Milliseconds())
+	t.fetch_time.WithLabelValues(gw.URL).Observe(float64(fr.Total.Milliseconds()))
 
 	log.Info("checking that we got a 404")
-	if resp.StatusCode != 404 {
-		t.fails.Inc()
-		return fmt.Errorf("expected to see 404 from gateway, but didn't. status: (%d): %w", resp.StatusCode, err)
+	if fr.StatusCode != 404 {
+		t.fails.WithLabelValues(gw.URL).Inc()
+		return res, res.Fail(task.Errorf(task.KindHTTPStatus, "expected to see 404 from gateway, but didn't. status: (%d)", fr.StatusCode))
 	}
 
-	return nil
+	return res, nil
 }
 
 func (t *NonExistCheck) Registration() *task.Registration {
@@ -8,43 +8,49 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 
 	shell "github.com/ipfs/go-ipfs-api"
-	pinning "github.com/ipfs/go-pinning-service-http-client"
 
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
 	"github.com/coryschwartz/gateway-monitor/pkg/task"
 )
 
 type NoopTask struct {
-	schedule string
-	i        int
-	g        prometheus.Gauge
+	reg *task.Registration
+	i   int
+	g   *prometheus.GaugeVec
 }
 
-func (t *NoopTask) Run(ctx context.Context, sh *shell.Shell, ps *pinning.Client, gw string) error {
+func (t *NoopTask) Run(ctx context.Context, sh *shell.Shell, ps *provider.Provider, gw gateway.Gateway) (*task.Result, error) {
+	res := task.NewResult()
+
 	for i := 0; i < t.i; i++ {
 		time.Sleep(time.Second)
 		fmt.Println("test")
-		t.g.Add(1)
+		t.g.WithLabelValues(gw.URL).Add(1)
 	}
-	return nil
+	return res, nil
 }
 
 func (t *NoopTask) Registration() *task.Registration {
-	return &task.Registration{
-		Collectors: []prometheus.Collector{t.g},
-		Schedule:   t.schedule,
-	}
+	return t.reg
 }
 
 func NewNoopTask(schedule string, i int) *NoopTask {
+	g := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "noop",
+			Name:      "noopgauge",
+		},
+		[]string{"gateway"},
+	)
 	return &NoopTask{
-		schedule: schedule,
-		i:        i,
-		g: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Namespace: "gatewaymonitor_task",
-				Subsystem: "noop",
-				Name:      "noopgauge",
-			},
-		),
+		reg: &task.Registration{
+			Name:       "noop",
+			Collectors: []prometheus.Collector{g},
+			Schedule:   schedule,
+		},
+		i: i,
+		g: g,
 	}
 }
@@ -0,0 +1,185 @@
+package tasks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+
+	shell "github.com/ipfs/go-ipfs-api"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// Shape is the layout of a generated payload.
+type Shape string
+
+const (
+	// A single file.
+	ShapeFile Shape = "file"
+	// A flat directory of small files.
+	ShapeManyFiles Shape = "many_files"
+	// Files spread over a deep chain of nested directories.
+	ShapeDeepDir Shape = "deep_dir"
+)
+
+const (
+	manyFilesSize = 4 * kiB
+	deepDirDepth  = 16
+)
+
+func ParseShape(s string) (Shape, error) {
+	switch sh := Shape(s); sh {
+	case "":
+		return ShapeFile, nil
+	case ShapeFile, ShapeManyFiles, ShapeDeepDir:
+		return sh, nil
+	default:
+		return "", fmt.Errorf("unknown payload shape %q", s)
+	}
+}
+
+// Payload is pseudo-random content that can be regenerated from its seed,
+// so that it never has to be kept in memory and can be reproduced later
+// when investigating a failure.
+type Payload struct {
+	Seed  int64
+	Size  int
+	Shape Shape
+}
+
+// NewPayload creates a payload with a random seed.
+func NewPayload(size int, shape Shape) (*Payload, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate seed: %w", err)
+	}
+	return &Payload{
+		Seed:  int64(binary.LittleEndian.Uint64(b[:]) &^ (1 << 63)),
+		Size:  size,
+		Shape: shape,
+	}, nil
+}
+
+// PayloadFile is one file of a payload.
+type PayloadFile struct {
+	// Path within the payload. Empty for ShapeFile.
+	Path string
+	Size int
+	seed int64
+}
+
+// Reader regenerates the content of the file.
+func (f PayloadFile) Reader() io.Reader {
+	return io.LimitReader(mrand.New(mrand.NewSource(f.seed)), int64(f.Size))
+}
+
+// Range regenerates length bytes of the file starting at offset.
+// The content before offset still has to be generated, so this is
+// only cheaper than Reader in memory, not in time.
+func (f PayloadFile) Range(offset, length int64) (io.Reader, error) {
+	r := f.Reader()
+	if _, err := io.CopyN(io.Discard, r, offset); err != nil {
+		return nil, fmt.Errorf("range starts past the end of the file: %w", err)
+	}
+	return io.LimitReader(r, length), nil
+}
+
+// Files lists the files of the payload. The sizes add up to the
+// size of the payload.
+func (p *Payload) Files() []PayloadFile {
+	if p.Shape == ShapeFile || p.Shape == "" {
+		return []PayloadFile{{Size: p.Size, seed: p.Seed}}
+	}
+
+	// every file gets its own seed, derived from the payload's
+	seeds := mrand.New(mrand.NewSource(p.Seed))
+	var fls []PayloadFile
+	switch p.Shape {
+	case ShapeManyFiles:
+		for i, left := 0, p.Size; left > 0; i++ {
+			size := manyFilesSize
+			if left < size {
+				size = left
+			}
+			fls = append(fls, PayloadFile{
+				Path: fmt.Sprintf("file-%06d", i),
+				Size: size,
+				seed: seeds.Int63(),
+			})
+			left -= size
+		}
+	case ShapeDeepDir:
+		// one file in each directory of the chain
+		per := p.Size / deepDirDepth
+		dir := ""
+		for i := 0; i < deepDirDepth; i++ {
+			dir = filepath.ToSlash(filepath.Join(dir, fmt.Sprintf("level-%02d", i)))
+			size := per
+			if i == deepDirDepth-1 {
+				size = p.Size - per*(deepDirDepth-1)
+			}
+			fls = append(fls, PayloadFile{
+				Path: dir + "/file",
+				Size: size,
+				seed: seeds.Int63(),
+			})
+		}
+	}
+	return fls
+}
+
+// Reader regenerates the content of a ShapeFile payload.
+func (p *Payload) Reader() io.Reader {
+	return p.Files()[0].Reader()
+}
+
+// IsDir is true for payloads that are directories.
+func (p *Payload) IsDir() bool {
+	return p.Shape != ShapeFile && p.Shape != ""
+}
+
+// Add adds the payload to the local IPFS node and returns its CID.
+func (p *Payload) Add(ctx context.Context, sh *shell.Shell) (string, error) {
+	if !p.IsDir() {
+		return sh.Add(p.Reader())
+	}
+	fls := make(map[string]files.Node)
+	for _, f := range p.Files() {
+		fls[f.Path] = files.NewReaderFile(f.Reader())
+	}
+	return addDirectory(ctx, sh, newDirectory(fls))
+}
+
+// WriteTo writes the payload to path on disk, as a file or a directory
+// depending on its shape.
+func (p *Payload) WriteTo(path string) error {
+	if !p.IsDir() {
+		return writeFile(path, p.Reader())
+	}
+	for _, f := range p.Files() {
+		fpath := filepath.Join(path, filepath.FromSlash(f.Path))
+		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			return err
+		}
+		if err := writeFile(fpath, f.Reader()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFile(path string, r io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,473 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/ipfs/go-cid"
+	shell "github.com/ipfs/go-ipfs-api"
+	pinning "github.com/ipfs/go-pinning-service-http-client"
+	"github.com/ipfs/go-pinning-service-http-client/openapi"
+	"github.com/multiformats/go-multiaddr"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
+)
+
+const conformanceSize = 1 * kiB
+
+// allStatuses is used as the status filter of list requests that look
+// for a pin whatever its status: services only list pinned pins by default.
+var allStatuses = []pinning.Status{
+	pinning.StatusQueued,
+	pinning.StatusPinning,
+	pinning.StatusPinned,
+	pinning.StatusFailed,
+}
+
+// ConformanceCheck is the outcome of one check of the conformance suite.
+type ConformanceCheck struct {
+	Name string
+	// Endpoint is the API operation the check times:
+	// add, get, list, replace or delete.
+	Endpoint string
+	Duration time.Duration
+	// Deviations from the Pinning Service API spec found by the check.
+	Deviations []string
+}
+
+func (c *ConformanceCheck) deviate(format string, a ...interface{}) {
+	c.Deviations = append(c.Deviations, fmt.Sprintf(format, a...))
+}
+
+// ConformanceReport lists the checks of a conformance run, in the order
+// they were made.
+type ConformanceReport struct {
+	Checks []*ConformanceCheck
+}
+
+// Deviations counts the deviations found by all checks.
+func (r *ConformanceReport) Deviations() int {
+	n := 0
+	for _, c := range r.Checks {
+		n += len(c.Deviations)
+	}
+	return n
+}
+
+// conformance is the state of a run of the suite.
+type conformance struct {
+	ps     *pinning.Client
+	report *ConformanceReport
+
+	name    string
+	meta    map[string]string
+	origins []multiaddr.Multiaddr
+}
+
+// call times one request to the pinning service. A request that fails is
+// a deviation, as every request of the suite is valid.
+func (s *conformance) call(name, endpoint string, fn func() error) (*ConformanceCheck, bool) {
+	check := &ConformanceCheck{
+		Name:     name,
+		Endpoint: endpoint,
+	}
+	s.report.Checks = append(s.report.Checks, check)
+	start := time.Now()
+	err := fn()
+	check.Duration = time.Since(start)
+	if err != nil {
+		check.deviate("request failed: %v", err)
+		return check, false
+	}
+	return check, true
+}
+
+// PinningConformance exercises the Pinning Service API of ps with content
+// added to the local node: it pins it with a name, meta and origins, lists
+// it with each filter, gets it, replaces it and deletes it. Deviations from
+// the spec are in the report; the error is for failures to run the suite.
+func PinningConformance(ctx context.Context, sh *shell.Shell, ps *pinning.Client) (*ConformanceReport, error) {
+	payload, err := NewPayload(2*conformanceSize, ShapeFile)
+	if err != nil {
+		return nil, err
+	}
+	seed := strconv.FormatInt(payload.Seed, 10)
+	log.Infow("running pinning service conformance suite", "seed", seed)
+
+	// the pin and its replacement, both added locally so that the
+	// service could actually fetch them
+	var cids []cid.Cid
+	for _, offset := range []int64{0, conformanceSize} {
+		r, err := payload.Files()[0].Range(offset, conformanceSize)
+		if err != nil {
+			return nil, err
+		}
+		cidstr, err := sh.Add(r)
+		if err != nil {
+			return nil, task.Errorf(task.KindLocalNode, "failed to write to IPFS: %w", err)
+		}
+		defer sh.Unpin(cidstr)
+		c, err := cid.Decode(cidstr)
+		if err != nil {
+			return nil, task.Errorf(task.KindLocalNode, "failed to decode cid after it was returned from IPFS: %w", err)
+		}
+		cids = append(cids, c)
+	}
+
+	id, err := sh.ID()
+	if err != nil {
+		return nil, task.Errorf(task.KindLocalNode, "failed to get the addresses of the local node: %w", err)
+	}
+	var origins []multiaddr.Multiaddr
+	for _, addr := range id.Addresses {
+		if ma, err := multiaddr.NewMultiaddr(addr); err == nil {
+			origins = append(origins, ma)
+		}
+	}
+
+	s := &conformance{
+		ps:     ps,
+		report: new(ConformanceReport),
+		name:   "gateway-monitor-conformance-" + seed,
+		meta: map[string]string{
+			"app":  "gateway-monitor",
+			"seed": seed,
+		},
+		origins: origins,
+	}
+	s.run(ctx, cids[0], cids[1])
+	return s.report, nil
+}
+
+func (s *conformance) run(ctx context.Context, c, replacement cid.Cid) {
+	var status pinning.PinStatusGetter
+	check, ok := s.call("add", "add", func() (err error) {
+		status, err = s.ps.Add(ctx, c,
+			pinning.PinOpts.WithName(s.name),
+			pinning.PinOpts.AddMeta(s.meta),
+			pinning.PinOpts.WithOrigins(s.origins...))
+		return err
+	})
+	if !ok {
+		// nothing else can be checked without a pin
+		return
+	}
+	s.checkStatus(check, status, c)
+	id := status.GetRequestId()
+	created := status.GetCreated()
+	if id == "" {
+		return
+	}
+	defer func() {
+		// remove the pin if the suite didn't get to delete it
+		if id != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			s.ps.DeleteByID(ctx, id)
+		}
+	}()
+
+	check, ok = s.call("get", "get", func() (err error) {
+		status, err = s.ps.GetStatusByID(ctx, id)
+		return err
+	})
+	if ok {
+		s.checkStatus(check, status, c)
+		if status.GetRequestId() != id {
+			check.deviate("requestid is %q, expected %q", status.GetRequestId(), id)
+		}
+	}
+
+	s.list(ctx, "list_cid", id, true, func(check *ConformanceCheck, p pinning.PinStatusGetter) {
+		if !p.GetPin().GetCid().Equals(c) {
+			check.deviate("listed pin %s has cid %s", p.GetRequestId(), p.GetPin().GetCid())
+		}
+	}, pinning.PinOpts.FilterCIDs(c), pinning.PinOpts.FilterStatus(allStatuses...))
+	s.list(ctx, "list_name", id, true, func(check *ConformanceCheck, p pinning.PinStatusGetter) {
+		if p.GetPin().GetName() != s.name {
+			check.deviate("listed pin %s has name %q", p.GetRequestId(), p.GetPin().GetName())
+		}
+	}, pinning.PinOpts.FilterName(s.name), pinning.PinOpts.FilterStatus(allStatuses...))
+	// the pin may change status between requests, so only check that the
+	// service applies the filter
+	s.list(ctx, "list_status", id, false, func(check *ConformanceCheck, p pinning.PinStatusGetter) {
+		if st := p.GetStatus(); st != pinning.StatusQueued && st != pinning.StatusPinning {
+			check.deviate("listed pin %s has status %q", p.GetRequestId(), st)
+		}
+	}, pinning.PinOpts.FilterStatus(pinning.StatusQueued, pinning.StatusPinning))
+	s.list(ctx, "list_meta", id, true, func(check *ConformanceCheck, p pinning.PinStatusGetter) {
+		if !hasMeta(p.GetPin().GetMeta(), s.meta) {
+			check.deviate("listed pin %s has meta %v", p.GetRequestId(), p.GetPin().GetMeta())
+		}
+	}, pinning.PinOpts.LsMeta(s.meta), pinning.PinOpts.FilterStatus(allStatuses...))
+	if !created.IsZero() {
+		s.list(ctx, "list_after", id, true, nil,
+			pinning.PinOpts.FilterName(s.name),
+			pinning.PinOpts.FilterAfter(created.Add(-time.Minute)),
+			pinning.PinOpts.FilterStatus(allStatuses...))
+		s.list(ctx, "list_before", id, false, func(check *ConformanceCheck, p pinning.PinStatusGetter) {
+			if p.GetRequestId() == id {
+				check.deviate("pin created at %s is listed before %s", created, created.Add(-time.Minute))
+			}
+		},
+			pinning.PinOpts.FilterName(s.name),
+			pinning.PinOpts.FilterBefore(created.Add(-time.Minute)),
+			pinning.PinOpts.FilterStatus(allStatuses...))
+	}
+
+	var (
+		results []pinning.PinStatusGetter
+		count   int
+	)
+	check, ok = s.call("list_limit", "list", func() (err error) {
+		results, count, err = s.ps.LsBatchSync(ctx, pinning.PinOpts.Limit(1), pinning.PinOpts.FilterStatus(allStatuses...))
+		return err
+	})
+	if ok {
+		if len(results) > 1 {
+			check.deviate("%d results returned with limit 1", len(results))
+		}
+		if count < 1 {
+			check.deviate("count is %d, but there is at least one pin", count)
+		}
+	}
+
+	check, ok = s.call("replace", "replace", func() (err error) {
+		status, err = s.ps.Replace(ctx, id, replacement,
+			pinning.PinOpts.WithName(s.name),
+			pinning.PinOpts.AddMeta(s.meta),
+			pinning.PinOpts.WithOrigins(s.origins...))
+		return err
+	})
+	if ok {
+		s.checkStatus(check, status, replacement)
+		if newID := status.GetRequestId(); newID != "" && newID != id {
+			old := id
+			id = newID
+			// the old request id may be gone, so its errors aren't deviations
+			var err error
+			check, _ = s.call("get_replaced", "get", func() error {
+				status, err = s.ps.GetStatusByID(ctx, old)
+				return nil
+			})
+			if err == nil {
+				check.deviate("replaced pin request %s is still there, with status %q", old, status.GetStatus())
+			}
+		}
+	}
+
+	check, ok = s.call("delete", "delete", func() error {
+		return s.ps.DeleteByID(ctx, id)
+	})
+	if ok {
+		deleted := id
+		id = ""
+		var err error
+		check, _ = s.call("get_deleted", "get", func() error {
+			status, err = s.ps.GetStatusByID(ctx, deleted)
+			return nil
+		})
+		if err == nil {
+			check.deviate("deleted pin request %s is still there, with status %q", deleted, status.GetStatus())
+		} else if code, ok := pinningStatusCode(err); !ok || code != http.StatusNotFound {
+			check.deviate("expected 404 for a deleted pin request: %v", err)
+		}
+	}
+}
+
+// list checks that a list request returns valid pins that pass each, and
+// that it includes the pin request id if want is set.
+func (s *conformance) list(ctx context.Context, name, id string, want bool, each func(*ConformanceCheck, pinning.PinStatusGetter), opts ...pinning.LsOption) {
+	var (
+		results []pinning.PinStatusGetter
+		count   int
+	)
+	check, ok := s.call(name, "list", func() (err error) {
+		results, count, err = s.ps.LsBatchSync(ctx, opts...)
+		return err
+	})
+	if !ok {
+		return
+	}
+	if count < len(results) {
+		check.deviate("count is %d, but %d results were returned", count, len(results))
+	}
+	found := false
+	for _, p := range results {
+		if p.GetRequestId() == id {
+			found = true
+		}
+		if each != nil {
+			each(check, p)
+		}
+	}
+	if want && !found {
+		check.deviate("pin request %s isn't listed", id)
+	}
+}
+
+// checkStatus validates a PinStatus returned for a pin of c.
+func (s *conformance) checkStatus(check *ConformanceCheck, status pinning.PinStatusGetter, c cid.Cid) {
+	if status.GetRequestId() == "" {
+		check.deviate("requestid is empty")
+	}
+	if status.GetStatus().String() == "" {
+		check.deviate("status %q is invalid", status.GetStatus())
+	}
+	if status.GetCreated().IsZero() {
+		check.deviate("created is missing")
+	}
+	if len(status.GetDelegates()) == 0 {
+		check.deviate("no valid delegates")
+	}
+	pin := status.GetPin()
+	if !pin.GetCid().Equals(c) {
+		check.deviate("pin has cid %s, expected %s", pin.GetCid(), c)
+	}
+	if pin.GetName() != s.name {
+		check.deviate("pin has name %q, expected %q", pin.GetName(), s.name)
+	}
+	if !hasMeta(pin.GetMeta(), s.meta) {
+		check.deviate("pin has meta %v, expected %v", pin.GetMeta(), s.meta)
+	}
+	origins := make(map[string]bool)
+	for _, o := range pin.GetOrigins() {
+		origins[o] = true
+	}
+	for _, o := range s.origins {
+		if !origins[o.String()] {
+			check.deviate("pin is missing origin %s", o)
+			break
+		}
+	}
+}
+
+// pinningStatusCode returns the HTTP status of a failed pinning service
+// request. The client only keeps it as the status line of a response
+// with a Failure body, the error of any other response is its own.
+func pinningStatusCode(err error) (int, bool) {
+	var oerr openapi.GenericOpenAPIError
+	if !errors.As(err, &oerr) {
+		return 0, false
+	}
+	if _, ok := oerr.Model().(openapi.Failure); !ok {
+		return 0, false
+	}
+	code, cerr := strconv.Atoi(strings.SplitN(oerr.Error(), " ", 2)[0])
+	return code, cerr == nil
+}
+
+func hasMeta(got, want map[string]string) bool {
+	for k, v := range want {
+		if got[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+type PinningConformanceCheck struct {
+	reg           *task.Registration
+	endpoint_time *prometheus.HistogramVec
+	deviations    *prometheus.CounterVec
+	fails         *prometheus.CounterVec
+	errors        *prometheus.CounterVec
+}
+
+func NewPinningConformanceCheck(schedule string) *PinningConformanceCheck {
+	endpoint_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "pinning_conformance",
+			Name:      "endpoint_seconds",
+		},
+		[]string{"provider", "endpoint"},
+	)
+	deviations := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "pinning_conformance",
+			Name:      "deviation_count",
+		},
+		[]string{"provider", "check"},
+	)
+	fails := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "pinning_conformance",
+			Name:      "fail_count",
+		},
+		[]string{"provider"},
+	)
+	errors := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "pinning_conformance",
+			Name:      "error_count",
+		},
+		[]string{"provider"},
+	)
+	reg := task.Registration{
+		Name:      "pinning_conformance",
+		Schedule:  schedule,
+		Pinning:   true,
+		NoGateway: true,
+		Collectors: []prometheus.Collector{
+			endpoint_time,
+			deviations,
+			fails,
+			errors,
+		},
+	}
+	return &PinningConformanceCheck{
+		reg:           &reg,
+		endpoint_time: endpoint_time,
+		deviations:    deviations,
+		fails:         fails,
+		errors:        errors,
+	}
+}
+
+// Run checks the pinning service, once per service whatever the gateways.
+func (t *PinningConformanceCheck) Run(ctx context.Context, sh *shell.Shell, ps *provider.Provider, gw gateway.Gateway) (*task.Result, error) {
+	res := task.NewResult()
+	if ps == nil {
+		t.errors.WithLabelValues("").Inc()
+		return res, task.Errorf(task.KindPinningService, "no pinning service configured, see --pinning-service or pinning_services")
+	}
+
+	report, err := PinningConformance(ctx, sh, ps.Client)
+	if err != nil {
+		t.errors.WithLabelValues(ps.Name).Inc()
+		return res, err
+	}
+	var failed []string
+	for _, check := range report.Checks {
+		res.AddPhase(check.Name, check.Duration)
+		t.endpoint_time.WithLabelValues(ps.Name, check.Endpoint).Observe(check.Duration.Seconds())
+		for _, d := range check.Deviations {
+			log.Warnw("pinning service deviates from the spec", "provider", ps, "check", check.Name, "deviation", d)
+			t.deviations.WithLabelValues(ps.Name, check.Name).Inc()
+			failed = append(failed, check.Name+": "+d)
+		}
+	}
+	res.Set("deviations", strconv.Itoa(len(failed)))
+	if len(failed) > 0 {
+		t.fails.WithLabelValues(ps.Name).Inc()
+		return res, res.Fail(task.Errorf(task.KindPinningService, "%d deviations from the pinning service API spec: %s", len(failed), strings.Join(failed, "; ")))
+	}
+	return res, nil
+}
+
+func (t *PinningConformanceCheck) Registration() *task.Registration {
+	return t.reg
+}
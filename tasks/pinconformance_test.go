@@ -0,0 +1,259 @@
+package tasks
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	shell "github.com/ipfs/go-ipfs-api"
+	pinning "github.com/ipfs/go-pinning-service-http-client"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// newFakeIPFS serves the parts of the IPFS HTTP API the conformance suite
+// uses: add, id and pin/rm.
+func newFakeIPFS(t *testing.T) *shell.Shell {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v0/add", func(w http.ResponseWriter, r *http.Request) {
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		part, err := multipart.NewReader(r.Body, params["boundary"]).NextPart()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(part)
+		sum := sha256.Sum256(data)
+		h, _ := mh.Encode(sum[:], mh.SHA2_256)
+		json.NewEncoder(w).Encode(map[string]string{"Hash": cid.NewCidV1(cid.Raw, h).String()})
+	})
+	mux.HandleFunc("/api/v0/id", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ID":        "12D3KooWDpJ7As7BWAwRMfu1VU2WCqNjvq387JEYKDBj4kx6nXTN",
+			"Addresses": []string{"/ip4/127.0.0.1/tcp/4001/p2p/12D3KooWDpJ7As7BWAwRMfu1VU2WCqNjvq387JEYKDBj4kx6nXTN"},
+		})
+	})
+	mux.HandleFunc("/api/v0/pin/rm", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]string{"Pins": {r.URL.Query().Get("arg")}})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return shell.NewShell(srv.URL)
+}
+
+type psaPin struct {
+	Cid     string            `json:"cid"`
+	Name    string            `json:"name,omitempty"`
+	Origins []string          `json:"origins,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+type psaStatus struct {
+	RequestID string    `json:"requestid"`
+	Status    string    `json:"status"`
+	Created   time.Time `json:"created"`
+	Pin       psaPin    `json:"pin"`
+	Delegates []string  `json:"delegates"`
+}
+
+// fakePSA is a stand-in for a pinning service. Its deviations from the
+// spec are switched on by its fields.
+type fakePSA struct {
+	// keepDeleted keeps pins that are deleted.
+	keepDeleted bool
+	// notFound is the status of requests for unknown pins, 404 if unset.
+	notFound int
+	// ignoreBefore ignores the before filter of list requests.
+	ignoreBefore bool
+
+	mu   sync.Mutex
+	pins map[string]*psaStatus
+	n    int
+}
+
+func (s *fakePSA) reply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *fakePSA) add(r *http.Request) *psaStatus {
+	var p psaPin
+	json.NewDecoder(r.Body).Decode(&p)
+	s.n++
+	st := &psaStatus{
+		RequestID: fmt.Sprintf("req%d", s.n),
+		Status:    "queued",
+		Created:   time.Now().UTC(),
+		Pin:       p,
+		Delegates: []string{"/ip4/1.2.3.4/tcp/4001/p2p/QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn"},
+	}
+	s.pins[st.RequestID] = st
+	return st
+}
+
+func (s *fakePSA) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	statuses := map[string]bool{"pinned": true}
+	if v := q.Get("status"); v != "" {
+		statuses = map[string]bool{}
+		for _, st := range strings.Split(v, ",") {
+			statuses[st] = true
+		}
+	}
+	var meta map[string]string
+	if v := q.Get("meta"); v != "" {
+		json.Unmarshal([]byte(v), &meta)
+	}
+	results := []*psaStatus{}
+	for _, st := range s.pins {
+		if !statuses[st.Status] {
+			continue
+		}
+		if v := q.Get("cid"); v != "" && !strings.Contains(","+v+",", ","+st.Pin.Cid+",") {
+			continue
+		}
+		if v := q.Get("name"); v != "" && v != st.Pin.Name {
+			continue
+		}
+		if v := q.Get("before"); v != "" && !s.ignoreBefore {
+			if before, _ := time.Parse(time.RFC3339, v); !st.Created.Before(before) {
+				continue
+			}
+		}
+		if v := q.Get("after"); v != "" {
+			if after, _ := time.Parse(time.RFC3339, v); !st.Created.After(after) {
+				continue
+			}
+		}
+		if !hasMeta(st.Pin.Meta, meta) {
+			continue
+		}
+		results = append(results, st)
+	}
+	count := len(results)
+	var limit int
+	fmt.Sscan(q.Get("limit"), &limit)
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	s.reply(w, http.StatusOK, map[string]interface{}{"count": count, "results": results})
+}
+
+func (s *fakePSA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.URL.Path == "/pins" {
+		if r.Method == http.MethodPost {
+			s.reply(w, http.StatusAccepted, s.add(r))
+		} else {
+			s.list(w, r)
+		}
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/pins/")
+	st, ok := s.pins[id]
+	if !ok {
+		code := s.notFound
+		if code == 0 {
+			code = http.StatusNotFound
+		}
+		s.reply(w, code, map[string]interface{}{"error": map[string]string{"reason": "NOT_FOUND"}})
+		return
+	}
+	switch r.Method {
+	case http.MethodDelete:
+		if !s.keepDeleted {
+			delete(s.pins, id)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPost:
+		delete(s.pins, id)
+		s.reply(w, http.StatusAccepted, s.add(r))
+	default:
+		s.reply(w, http.StatusOK, st)
+	}
+}
+
+func TestPinningConformance(t *testing.T) {
+	sh := newFakeIPFS(t)
+	for _, tc := range []struct {
+		name string
+		psa  *fakePSA
+		// the checks expected to deviate
+		deviate []string
+	}{
+		{"conformant", &fakePSA{}, nil},
+		{"keeps deleted pins", &fakePSA{keepDeleted: true}, []string{"get_deleted"}},
+		{"unknown pin isn't 404", &fakePSA{notFound: http.StatusBadRequest}, []string{"get_deleted"}},
+		{"ignores before", &fakePSA{ignoreBefore: true}, []string{"list_before"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.psa.pins = make(map[string]*psaStatus)
+			srv := httptest.NewServer(tc.psa)
+			defer srv.Close()
+
+			report, err := PinningConformance(context.Background(), sh, pinning.NewClient(srv.URL, "token"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			deviated := map[string]bool{}
+			for _, c := range report.Checks {
+				if len(c.Deviations) > 0 {
+					deviated[c.Name] = true
+					t.Logf("%s: %v", c.Name, c.Deviations)
+				}
+			}
+			for _, name := range tc.deviate {
+				if !deviated[name] {
+					t.Errorf("expected %s to deviate", name)
+				}
+				delete(deviated, name)
+			}
+			for name := range deviated {
+				t.Errorf("unexpected deviation of %s", name)
+			}
+			if tc.psa.keepDeleted {
+				return
+			}
+			if len(tc.psa.pins) != 0 {
+				t.Errorf("expected every pin to be deleted, %d are left", len(tc.psa.pins))
+			}
+		})
+	}
+}
+
+func TestPinningStatusCode(t *testing.T) {
+	psa := &fakePSA{pins: make(map[string]*psaStatus)}
+	srv := httptest.NewServer(psa)
+	defer srv.Close()
+	c := pinning.NewClient(srv.URL, "token")
+
+	for _, code := range []int{http.StatusNotFound, http.StatusGone} {
+		psa.mu.Lock()
+		psa.notFound = code
+		psa.mu.Unlock()
+		_, err := c.GetStatusByID(context.Background(), "missing")
+		if got, ok := pinningStatusCode(err); !ok || got != code {
+			t.Errorf("expected status %d, got %d (%v): %v", code, got, ok, err)
+		}
+	}
+	if _, ok := pinningStatusCode(fmt.Errorf("404")); ok {
+		t.Error("expected no status for an error that isn't a response")
+	}
+}
@@ -0,0 +1,345 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	shell "github.com/ipfs/go-ipfs-api"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/fetch"
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
+	"github.com/coryschwartz/gateway-monitor/pkg/routing"
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
+	"github.com/coryschwartz/gateway-monitor/pkg/verify"
+)
+
+// DefaultRoutingEndpoint is a public Delegated Routing HTTP API endpoint.
+const DefaultRoutingEndpoint = "https://delegated-ipfs.dev"
+
+const (
+	// Routers the provider record is looked up with.
+	routerDHT       = "dht"
+	routerDelegated = "delegated"
+
+	// how long to keep looking for the provider record
+	providerDiscoveryTimeout = 5 * time.Minute
+	// type of the query events of `dht findprovs` that list providers
+	queryEventProvider = 4
+)
+
+// providerPollBackoff is how often the routers are asked for the
+// provider record until they have it.
+var providerPollBackoff = task.Backoff{
+	Initial:    time.Second,
+	Max:        15 * time.Second,
+	Multiplier: 2,
+}
+
+// ProviderRecordBench adds content to the local node and measures how long
+// it takes for the node's provider record to be discoverable, while the
+// gateway fetches the content. Comparing the two tells whether a slow
+// gateway was slow to find the node or to transfer from it.
+type ProviderRecordBench struct {
+	reg            *task.Registration
+	size           int
+	delegate       *routing.Client
+	discovery_time *prometheus.HistogramVec
+	ttfb_time      *prometheus.HistogramVec
+	retrieval_time *prometheus.HistogramVec
+	undiscovered   *prometheus.CounterVec
+	fails          *prometheus.CounterVec
+	errors         *prometheus.CounterVec
+}
+
+// NewProviderRecordBench looks the provider record up with the local
+// node's DHT, and with the delegated routing endpoint if it isn't empty.
+func NewProviderRecordBench(schedule string, size int, endpoint string) *ProviderRecordBench {
+	discovery_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "provider_record",
+			Name:      fmt.Sprintf("%d_discovery_seconds", size),
+			Buckets:   prometheus.ExponentialBuckets(0.25, 2, 12),
+		},
+		[]string{"gateway", "router"},
+	)
+	ttfb_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "provider_record",
+			Name:      fmt.Sprintf("%d_ttfb_seconds", size),
+			Buckets:   prometheus.ExponentialBuckets(0.25, 2, 12),
+		},
+		[]string{"gateway"},
+	)
+	retrieval_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "provider_record",
+			Name:      fmt.Sprintf("%d_retrieval_seconds", size),
+			Buckets:   prometheus.ExponentialBuckets(0.25, 2, 12),
+		},
+		[]string{"gateway", "router"},
+	)
+	undiscovered := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "provider_record",
+			Name:      "undiscovered_count",
+		},
+		[]string{"gateway", "router"},
+	)
+	fails := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "provider_record",
+			Name:      "fail_count",
+		},
+		[]string{"gateway"},
+	)
+	errors := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "provider_record",
+			Name:      "error_count",
+		},
+		[]string{"gateway"},
+	)
+	var delegate *routing.Client
+	if endpoint != "" {
+		delegate = routing.New(endpoint)
+	}
+	reg := task.Registration{
+		Name:     fmt.Sprintf("provider_record_%d", size),
+		Schedule: schedule,
+		Group:    BandwidthGroup,
+		Collectors: []prometheus.Collector{
+			discovery_time,
+			ttfb_time,
+			retrieval_time,
+			undiscovered,
+			fails,
+			errors,
+		},
+	}
+	return &ProviderRecordBench{
+		reg:            &reg,
+		size:           size,
+		delegate:       delegate,
+		discovery_time: discovery_time,
+		ttfb_time:      ttfb_time,
+		retrieval_time: retrieval_time,
+		undiscovered:   undiscovered,
+		fails:          fails,
+		errors:         errors,
+	}
+}
+
+// discovery is when a router first returned the provider record.
+type discovery struct {
+	router  string
+	elapsed time.Duration
+	err     error
+}
+
+func (t *ProviderRecordBench) Run(ctx context.Context, sh *shell.Shell, ps *provider.Provider, gw gateway.Gateway) (*task.Result, error) {
+	res := task.NewResult()
+
+	self, err := sh.ID()
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, task.Errorf(task.KindLocalNode, "failed to get the peer id of the local node: %w", err)
+	}
+
+	payload, err := NewPayload(t.size, ShapeFile)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, err
+	}
+	log.Infow("generating random data", "bytes", t.size, "seed", payload.Seed)
+	res.Set("seed", strconv.FormatInt(payload.Seed, 10))
+
+	root, unpin, err := addPayload(res, sh, payload, t.errors.WithLabelValues(gw.URL))
+	if err != nil {
+		return res, err
+	}
+	defer unpin()
+	cidstr := root.String()
+	added := time.Now()
+
+	// look for the provider record while the gateway looks for the content
+	dctx, cancel := context.WithTimeout(ctx, providerDiscoveryTimeout)
+	defer cancel()
+	discoveries := make(chan discovery)
+	routers := 0
+	discover := func(router string, find func(context.Context) (bool, error)) {
+		routers++
+		go func() {
+			elapsed, err := t.poll(dctx, find)
+			discoveries <- discovery{router: router, elapsed: elapsed, err: err}
+		}()
+	}
+	discover(routerDHT, func(ctx context.Context) (bool, error) {
+		return dhtHasProvider(ctx, sh, cidstr, self.ID)
+	})
+	if t.delegate != nil {
+		discover(routerDelegated, func(ctx context.Context) (bool, error) {
+			return delegateHasProvider(ctx, t.delegate, cidstr, self.ID)
+		})
+	}
+
+	url := gw.Path("/ipfs/" + cidstr)
+	log.Infow("fetching from gateway", "url", url)
+	res.Set("url", url)
+	v := verify.NewReaderVerifier(payload.Reader(), int64(t.size))
+	fr, fetchErr := fetch.Get(ctx, url, v)
+	recordFetch(res, fr)
+	var ttfb time.Duration
+	if fr != nil && fr.TTFB > 0 {
+		// the request was sent right after adding, so this is
+		// also the time since the content was added
+		ttfb = fr.TTFB
+		log.Infow("first byte received", "ms", ttfb.Milliseconds())
+		t.ttfb_time.WithLabelValues(gw.URL).Observe(ttfb.Seconds())
+	}
+
+	var routerErr error
+	for i := 0; i < routers; i++ {
+		d := <-discoveries
+		if d.err != nil {
+			// not being discoverable is a result, not an error, but
+			// failing to ask is
+			log.Warnw("provider record wasn't discovered", "router", d.router, "seconds", time.Since(added).Seconds(), "err", d.err)
+			t.undiscovered.WithLabelValues(gw.URL, d.router).Inc()
+			res.Set(d.router+"_discovered", "false")
+			if !errors.Is(d.err, context.DeadlineExceeded) {
+				routerErr = fmt.Errorf("%s: %w", d.router, d.err)
+			}
+			continue
+		}
+		log.Infow("provider record discovered", "router", d.router, "ms", d.elapsed.Milliseconds())
+		res.AddPhase(d.router+"_discovery", d.elapsed)
+		t.discovery_time.WithLabelValues(gw.URL, d.router).Observe(d.elapsed.Seconds())
+		if ttfb == 0 {
+			// the gateway never responded, there is nothing to compare
+			continue
+		}
+		res.Set(d.router+"_ttfb_minus_discovery_ms", strconv.FormatInt((ttfb-d.elapsed).Milliseconds(), 10))
+		if ttfb > d.elapsed {
+			// how long the gateway took once it could have found us
+			t.retrieval_time.WithLabelValues(gw.URL, d.router).Observe((ttfb - d.elapsed).Seconds())
+		}
+	}
+
+	if fetchErr != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, task.Errorf(task.KindNetwork, "failed to fetch from gateway: %w", fetchErr)
+	}
+	if err := checkStatus(fr, http.StatusOK); err != nil {
+		t.fails.WithLabelValues(gw.URL).Inc()
+		return res, res.Fail(fmt.Errorf("failed to fetch generated content from gateway: %s: %w", url, err))
+	}
+	if err := checkContent(res, v); err != nil {
+		t.fails.WithLabelValues(gw.URL).Inc()
+		return res, res.Fail(fmt.Errorf("expected response from gateway to match generated content: %s: %w", url, err))
+	}
+	if routerErr != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, routerErr
+	}
+	return res, nil
+}
+
+// poll calls find until it reports the provider record was found, and
+// returns how long that took. If it never is, the error is the last one
+// find returned, if any.
+func (t *ProviderRecordBench) poll(ctx context.Context, find func(context.Context) (bool, error)) (time.Duration, error) {
+	start := time.Now()
+	var last error
+	for attempt := 0; ; attempt++ {
+		found, err := find(ctx)
+		if found {
+			return time.Since(start), nil
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Warnw("failed to look up provider record", "err", err)
+			last = err
+		}
+		select {
+		case <-time.After(providerPollBackoff.Delay(attempt)):
+		case <-ctx.Done():
+			if last != nil {
+				return 0, last
+			}
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// dhtHasProvider asks the local node to find the providers of cid,
+// returning as soon as peer is one of them.
+func dhtHasProvider(ctx context.Context, sh *shell.Shell, cid, peer string) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resp, err := sh.Request("dht/findprovs", cid).
+		Option("num-providers", 20).
+		Send(ctx)
+	if err != nil {
+		return false, task.Errorf(task.KindLocalNode, "failed to find providers: %w", err)
+	}
+	defer resp.Close()
+	if resp.Error != nil {
+		return false, task.Errorf(task.KindLocalNode, "failed to find providers: %w", resp.Error)
+	}
+	dec := json.NewDecoder(resp.Output)
+	for {
+		var ev struct {
+			Type      int
+			Responses []struct {
+				ID string
+			}
+		}
+		if err := dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				return false, nil
+			}
+			return false, task.Errorf(task.KindLocalNode, "failed to read providers: %w", err)
+		}
+		if ev.Type != queryEventProvider {
+			continue
+		}
+		for _, r := range ev.Responses {
+			if r.ID == peer {
+				return true, nil
+			}
+		}
+	}
+}
+
+// delegateHasProvider asks the delegated routing endpoint whether peer
+// provides cid.
+func delegateHasProvider(ctx context.Context, c *routing.Client, cid, peer string) (bool, error) {
+	recs, err := c.FindProviders(ctx, cid)
+	if err != nil {
+		return false, task.Errorf(task.KindNetwork, "failed to find providers: %w", err)
+	}
+	for _, r := range recs {
+		if r.ID == peer {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (t *ProviderRecordBench) Registration() *task.Registration {
+	return t.reg
+}
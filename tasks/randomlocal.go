@@ -1,60 +1,80 @@
 package tasks
 
 import (
-	"bytes"
 	"context"
-	"crypto/rand"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"net/http/httptrace"
-	"reflect"
+	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 
 	shell "github.com/ipfs/go-ipfs-api"
-	pinning "github.com/ipfs/go-pinning-service-http-client"
 
+	"github.com/coryschwartz/gateway-monitor/pkg/fetch"
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
 	"github.com/coryschwartz/gateway-monitor/pkg/task"
+	"github.com/coryschwartz/gateway-monitor/pkg/verify"
 )
 
 type RandomLocalBench struct {
 	reg        *task.Registration
 	size       int
-	start_time prometheus.Histogram
-	fetch_time prometheus.Histogram
-	fails      prometheus.Counter
-	errors     prometheus.Counter
+	shape      Shape
+	start_time *prometheus.HistogramVec
+	fetch_time *prometheus.HistogramVec
+	fails      *prometheus.CounterVec
+	errors     *prometheus.CounterVec
 }
 
 func NewRandomLocalBench(schedule string, size int) *RandomLocalBench {
-	start_time := prometheus.NewHistogram(
+	return NewRandomLocalShapeBench(schedule, size, ShapeFile)
+}
+
+// NewRandomLocalShapeBench benchmarks a payload of the given shape.
+// Directory payloads are fetched file by file.
+func NewRandomLocalShapeBench(schedule string, size int, shape Shape) *RandomLocalBench {
+	prefix := fmt.Sprintf("%d", size)
+	if shape != ShapeFile {
+		prefix = fmt.Sprintf("%d_%s", size, shape)
+	}
+	start_time := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "random_local",
-			Name:      fmt.Sprintf("%d_latency", size),
-		})
-	fetch_time := prometheus.NewHistogram(
+			Name:      prefix + "_latency",
+		},
+		[]string{"gateway"},
+	)
+	fetch_time := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "random_local",
-			Name:      fmt.Sprintf("%d_fetch_time", size),
-		})
-	fails := prometheus.NewCounter(
+			Name:      prefix + "_fetch_time",
+		},
+		[]string{"gateway"},
+	)
+	fails := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "random_local",
 			Name:      "fail_count",
-		})
-	errors := prometheus.NewCounter(
+		},
+		[]string{"gateway"},
+	)
+	errors := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "random_local",
 			Name:      "error_count",
-		})
+		},
+		[]string{"gateway"},
+	)
 	reg := task.Registration{
+		Name:     "random_local_" + prefix,
 		Schedule: schedule,
+		Group:    BandwidthGroup,
 		Collectors: []prometheus.Collector{
 			start_time,
 			fetch_time,
@@ -65,6 +85,7 @@ func NewRandomLocalBench(schedule string, size int) *RandomLocalBench {
 	return &RandomLocalBench{
 		reg:        &reg,
 		size:       size,
+		shape:      shape,
 		start_time: start_time,
 		fetch_time: fetch_time,
 		fails:      fails,
@@ -72,74 +93,94 @@ func NewRandomLocalBench(schedule string, size int) *RandomLocalBench {
 	}
 }
 
-func (t *RandomLocalBench) Run(ctx context.Context, sh *shell.Shell, ps *pinning.Client, gw string) error {
+func (t *RandomLocalBench) Run(ctx context.Context, sh *shell.Shell, ps *provider.Provider, gw gateway.Gateway) (*task.Result, error) {
+	res := task.NewResult()
 
-	// generate random data
-	log.Infof("generating %d bytes random data", t.size)
-	randb := make([]byte, t.size)
-	if _, err := rand.Read(randb); err != nil {
-		t.errors.Inc()
-		return fmt.Errorf("failed to generate random values: %w", err)
+	// generate random data from a seed, so it can be regenerated
+	// to verify the response, and reproduced later with `replay`.
+	payload, err := NewPayload(t.size, t.shape)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, err
 	}
-	buf := bytes.NewReader(randb)
+	log.Infow("generating random data", "bytes", t.size, "shape", t.shape, "seed", payload.Seed)
+	res.Set("seed", strconv.FormatInt(payload.Seed, 10))
+	res.Set("shape", string(t.shape))
 
 	// add to local ipfs
 	log.Info("writing data to local IPFS node")
-	cidstr, err := sh.Add(buf)
+	add_start := time.Now()
+	cidstr, err := payload.Add(ctx, sh)
+	res.AddPhase("add", time.Since(add_start))
+	res.CID = cidstr
 	if err != nil {
-		t.errors.Inc()
-		return fmt.Errorf("failed to write to IPFS: %w", err)
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, task.Errorf(task.KindLocalNode, "failed to write to IPFS: %w", err)
 	}
 	defer func() {
 		log.Info("cleaning up IPFS node")
 		err := sh.Unpin(cidstr)
 		if err != nil {
 			log.Warnw("failed to clean unpin cid.", "cid", cidstr)
-			t.errors.Inc()
+			t.errors.WithLabelValues(gw.URL).Inc()
 		}
 	}()
 
 	// request from gateway, observing client metrics
-	url := fmt.Sprintf("%s/ipfs/%s", gw, cidstr)
-	log.Infow("fetching from gateway", "url", url)
-	req, _ := http.NewRequest("GET", url, nil)
-	start := time.Now()
-	var firstbyte_time time.Time
-	trace := &httptrace.ClientTrace{
-		GotFirstResponseByte: func() {
-			latency := time.Since(start).Milliseconds()
-			log.Infow("first byte received", "ms", latency)
-			t.start_time.Observe(float64(latency))
-			common_fetch_latency.Set(float64(latency))
-			firstbyte_time = time.Now()
-		},
-	}
-	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		t.errors.Inc()
-		return fmt.Errorf("failed to fetch from gateway %w", err)
+	var (
+		total    time.Duration
+		transfer time.Duration
+		received int64
+	)
+	for i, f := range payload.Files() {
+		p := "/ipfs/" + cidstr
+		if f.Path != "" {
+			p += "/" + f.Path
+		}
+		url := gw.Path(p)
+		log.Infow("fetching from gateway", "url", url)
+		v := verify.NewReaderVerifier(f.Reader(), int64(f.Size))
+		fr, err := fetch.Get(ctx, url, v)
+		if i == 0 {
+			// the first request is the one that has to find the content
+			res.Set("url", url)
+			recordFetch(res, fr)
+			if fr != nil && fr.TTFB > 0 {
+				log.Infow("first byte received", "ms", fr.TTFB.Milliseconds())
+				t.start_time.WithLabelValues(gw.URL).Observe(float64(fr.TTFB.Milliseconds()))
+				common_fetch_latency.WithLabelValues(gw.URL, "").Set(float64(fr.TTFB.Milliseconds()))
+			}
+		} else if fr != nil {
+			res.Bytes += fr.Size
+		}
+		if err != nil {
+			t.errors.WithLabelValues(gw.URL).Inc()
+			return res, task.Errorf(task.KindNetwork, "failed to fetch from gateway: %w", err)
+		}
+		total += fr.Total
+		transfer += fr.Transfer
+		received += fr.Size
+
+		if err := checkStatus(fr, http.StatusOK); err != nil {
+			t.fails.WithLabelValues(gw.URL).Inc()
+			return res, res.Fail(fmt.Errorf("failed to fetch generated content from gateway: %s: %w", url, err))
+		}
+		// compare response with what we sent
+		if err := checkContent(res, v); err != nil {
+			t.fails.WithLabelValues(gw.URL).Inc()
+			return res, res.Fail(fmt.Errorf("expected response from gateway to match generated content: %s: %w", url, err))
+		}
 	}
-	respb, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		t.errors.Inc()
-		return fmt.Errorf("failed to download content: %w", err)
+	log.Infow("finished download", "ms", total.Milliseconds())
+	if payload.IsDir() {
+		res.AddPhase("fetch_all", total)
 	}
-	total_time := time.Since(start).Milliseconds()
-	download_time := time.Since(firstbyte_time).Seconds()
-	log.Infow("finished download", "ms", total_time)
-	t.fetch_time.Observe(float64(total_time))
-	downloadBytesPerSecond := float64(t.size) / download_time
-	common_fetch_speed.Set(downloadBytesPerSecond)
-
-	log.Info("checking result")
-	// compare response with what we sent
-	if !reflect.DeepEqual(respb, randb) {
-		t.fails.Inc()
-		return fmt.Errorf("expected response from gateway to match generated content: %s", url)
+	t.fetch_time.WithLabelValues(gw.URL).Observe(float64(total.Milliseconds()))
+	if transfer > 0 {
+		common_fetch_speed.WithLabelValues(gw.URL, "").Set(float64(received) / transfer.Seconds())
 	}
 
-	return nil
+	return res, nil
 }
 
 func (t *RandomLocalBench) Registration() *task.Registration {
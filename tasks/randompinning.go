@@ -1,14 +1,10 @@
 package tasks
 
 import (
-	"bytes"
 	"context"
-	"crypto/rand"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"net/http/httptrace"
-	"reflect"
+	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -17,55 +13,104 @@ import (
 	shell "github.com/ipfs/go-ipfs-api"
 	pinning "github.com/ipfs/go-pinning-service-http-client"
 
+	"github.com/coryschwartz/gateway-monitor/pkg/fetch"
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
 	"github.com/coryschwartz/gateway-monitor/pkg/task"
+	"github.com/coryschwartz/gateway-monitor/pkg/verify"
 )
 
+// pinPollBackoff is how often the status of a pin request is polled.
+// Services queue requests for a while before they start pinning, so the
+// interval grows, but stays short enough to time the transitions.
+var pinPollBackoff = task.Backoff{
+	Initial:    time.Second,
+	Max:        30 * time.Second,
+	Multiplier: 2,
+}
+
+// pinStages are the statuses a pin request goes through, in order.
+var pinStages = []pinning.Status{
+	pinning.StatusQueued,
+	pinning.StatusPinning,
+	pinning.StatusPinned,
+}
+
 type RandomPinningBench struct {
 	reg        *task.Registration
 	size       int
-	start_time prometheus.Histogram
-	fetch_time prometheus.Histogram
-	fails      prometheus.Counter
-	errors     prometheus.Counter
+	stage_time map[pinning.Status]*prometheus.HistogramVec
+	start_time *prometheus.HistogramVec
+	fetch_time *prometheus.HistogramVec
+	fails      *prometheus.CounterVec
+	errors     *prometheus.CounterVec
 }
 
 func NewRandomPinningBench(schedule string, size int) *RandomPinningBench {
-	start_time := prometheus.NewHistogram(
+	stage_time := make(map[pinning.Status]*prometheus.HistogramVec, len(pinStages))
+	for _, status := range pinStages {
+		stage_time[status] = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "gatewaymonitor_task",
+				Subsystem: "random_pinning",
+				Name:      fmt.Sprintf("%d_%s_seconds", size, status),
+				Buckets:   prometheus.ExponentialBuckets(0.25, 2, 14),
+			},
+			[]string{"gateway", "provider"},
+		)
+	}
+	start_time := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "random_pinning",
 			Name:      fmt.Sprintf("%d_latency", size),
-		})
-	fetch_time := prometheus.NewHistogram(
+		},
+		[]string{"gateway", "provider"},
+	)
+	fetch_time := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "random_pinning",
 			Name:      fmt.Sprintf("%d_fetch_time", size),
-		})
-	fails := prometheus.NewCounter(
+		},
+		[]string{"gateway", "provider"},
+	)
+	fails := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "random_pinning",
 			Name:      "fail_count",
-		})
-	errors := prometheus.NewCounter(
+		},
+		[]string{"gateway", "provider"},
+	)
+	errors := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "random_pinning",
 			Name:      "error_count",
-		})
-	reg := task.Registration{
-		Schedule: schedule,
-		Collectors: []prometheus.Collector{
-			start_time,
-			fetch_time,
-			fails,
-			errors,
 		},
+		[]string{"gateway", "provider"},
+	)
+	collectors := []prometheus.Collector{
+		start_time,
+		fetch_time,
+		fails,
+		errors,
+	}
+	for _, status := range pinStages {
+		collectors = append(collectors, stage_time[status])
+	}
+	reg := task.Registration{
+		Name:       fmt.Sprintf("random_pinning_%d", size),
+		Schedule:   schedule,
+		Group:      BandwidthGroup,
+		Pinning:    true,
+		Collectors: collectors,
 	}
 	return &RandomPinningBench{
 		reg:        &reg,
 		size:       size,
+		stage_time: stage_time,
 		start_time: start_time,
 		fetch_time: fetch_time,
 		fails:      fails,
@@ -73,22 +118,32 @@ func NewRandomPinningBench(schedule string, size int) *RandomPinningBench {
 	}
 }
 
-func (t *RandomPinningBench) Run(ctx context.Context, sh *shell.Shell, ps *pinning.Client, gw string) error {
-	// generate random data
-	log.Infof("generating %d bytes random data", t.size)
-	randb := make([]byte, t.size)
-	if _, err := rand.Read(randb); err != nil {
-		t.errors.Inc()
-		return fmt.Errorf("failed to generate random values: %w", err)
+func (t *RandomPinningBench) Run(ctx context.Context, sh *shell.Shell, ps *provider.Provider, gw gateway.Gateway) (*task.Result, error) {
+	res := task.NewResult()
+	if ps == nil {
+		t.errors.WithLabelValues(gw.URL, "").Inc()
+		return res, task.Errorf(task.KindPinningService, "no pinning service configured, see --pinning-service or pinning_services")
 	}
-	buf := bytes.NewReader(randb)
+
+	// generate random data from a seed, so it can be regenerated
+	// to verify the response, and reproduced later with `replay`.
+	payload, err := NewPayload(t.size, ShapeFile)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL, ps.Name).Inc()
+		return res, err
+	}
+	log.Infow("generating random data", "bytes", t.size, "seed", payload.Seed)
+	res.Set("seed", strconv.FormatInt(payload.Seed, 10))
 
 	// add to local ipfs
 	log.Info("writing data to local IPFS node")
-	cidstr, err := sh.Add(buf)
+	add_start := time.Now()
+	cidstr, err := sh.Add(payload.Reader())
+	res.AddPhase("add", time.Since(add_start))
+	res.CID = cidstr
 	if err != nil {
-		t.errors.Inc()
-		log.Errorw("failed to write to IPFS: %w", err)
+		t.errors.WithLabelValues(gw.URL, ps.Name).Inc()
+		return res, task.Errorf(task.KindLocalNode, "failed to write to IPFS: %w", err)
 	}
 	defer func() {
 		log.Info("cleaning up IPFS node")
@@ -99,78 +154,123 @@ func (t *RandomPinningBench) Run(ctx context.Context, sh *shell.Shell, ps *pinni
 	// Pin to pinning service
 	c, err := cid.Decode(cidstr)
 	if err != nil {
-		t.errors.Inc()
-		return fmt.Errorf("failed to decode cid after it was returned from IPFS: %w", err)
+		t.errors.WithLabelValues(gw.URL, ps.Name).Inc()
+		return res, task.Errorf(task.KindLocalNode, "failed to decode cid after it was returned from IPFS: %w", err)
 	}
-	getter, err := ps.Add(ctx, c)
+	pin_start := time.Now()
+	status, err := ps.Add(ctx, c, pinning.PinOpts.WithName("gateway-monitor "+strconv.FormatInt(payload.Seed, 10)))
 	if err != nil {
-		t.errors.Inc()
-		return fmt.Errorf("failed to pin cid to pinning service: %w", err)
-	}
-
-	// long poll pinning service
-	log.Info("waiting for pinning service to complete the pin")
-	var pinned bool
-	for !pinned {
-		status, err := ps.GetStatusByID(ctx, getter.GetRequestId())
-		if err == nil {
-			fmt.Println(status.GetStatus())
-			pinned = status.GetStatus() == pinning.StatusPinned
-		} else {
-			fmt.Println(err)
+		t.errors.WithLabelValues(gw.URL, ps.Name).Inc()
+		return res, task.Errorf(task.KindPinningService, "failed to pin cid to pinning service: %w", err)
+	}
+	id := status.GetRequestId()
+	res.Set("request_id", id)
+	defer func() {
+		// the run's context may be what ended it, so give the service
+		// a little time of its own to forget the pin.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		log.Infow("removing pin from pinning service", "request_id", id)
+		if err := ps.DeleteByID(ctx, id); err != nil {
+			log.Warnw("failed to remove pin from pinning service", "request_id", id, "err", err)
+			t.errors.WithLabelValues(gw.URL, ps.Name).Inc()
+		}
+	}()
+
+	// poll the pinning service until the pin is done
+	log.Infow("waiting for pinning service to complete the pin", "provider", ps, "request_id", id)
+	reached := 0
+	for attempt := 0; ; attempt++ {
+		if status != nil {
+			log.Infow("pin status", "request_id", id, "status", status.GetStatus())
+			if status.GetStatus() == pinning.StatusFailed {
+				t.errors.WithLabelValues(gw.URL, ps.Name).Inc()
+				res.Set("pin_status", status.GetStatus().String())
+				return res, task.Errorf(task.KindPinningService, "pinning service failed to pin %s after %s", cidstr, time.Since(pin_start).Round(time.Second))
+			}
+			reached = t.observeStages(res, gw, ps, status.GetStatus(), reached, time.Since(pin_start))
+			if reached == len(pinStages) {
+				break
+			}
+		}
+
+		select {
+		case <-time.After(pinPollBackoff.Delay(attempt)):
+		case <-ctx.Done():
+			t.errors.WithLabelValues(gw.URL, ps.Name).Inc()
+			if reached > 0 {
+				res.Set("pin_status", pinStages[reached-1].String())
+			}
+			return res, task.Errorf(task.KindTimeout, "pinning service didn't pin %s within %s: %w", cidstr, time.Since(pin_start).Round(time.Second), ctx.Err())
+		}
+		status, err = ps.GetStatusByID(ctx, id)
+		if err != nil {
+			// keep polling, the next request may get through
+			log.Warnw("failed to get pin status", "request_id", id, "err", err)
+			status = nil
 		}
-		time.Sleep(time.Minute)
 	}
+	res.Set("pin_status", pinning.StatusPinned.String())
 
 	// delete this from our local IPFS node.
 	log.Info("removing pin from local IPFS node")
 	err = sh.Unpin(cidstr)
 	if err != nil {
-		t.errors.Inc()
-		return fmt.Errorf("could not unpin cid after adding it earlier: %w", err)
+		t.errors.WithLabelValues(gw.URL, ps.Name).Inc()
+		return res, task.Errorf(task.KindLocalNode, "could not unpin cid after adding it earlier: %w", err)
 	}
 
 	// request from gateway, observing client metrics
-	url := fmt.Sprintf("%s/ipfs/%s", gw, cidstr)
+	url := gw.Path("/ipfs/" + cidstr)
 	log.Infow("fetching from gateway", "url", url)
-	req, _ := http.NewRequest("GET", url, nil)
-	start := time.Now()
-	var firstbyte_time time.Time
-	trace := &httptrace.ClientTrace{
-		GotFirstResponseByte: func() {
-			latency := time.Since(start).Milliseconds()
-			log.Infow("first byte received", "ms", latency)
-			t.start_time.Observe(float64(latency))
-			common_fetch_latency.Set(float64(latency))
-			firstbyte_time = time.Now()
-		},
+	res.Set("url", url)
+	v := verify.NewReaderVerifier(payload.Reader(), int64(t.size))
+	fr, err := fetch.Get(ctx, url, v)
+	recordFetch(res, fr)
+	if fr != nil && fr.TTFB > 0 {
+		log.Infow("first byte received", "ms", fr.TTFB.Milliseconds())
+		t.start_time.WithLabelValues(gw.URL, ps.Name).Observe(float64(fr.TTFB.Milliseconds()))
+		common_fetch_latency.WithLabelValues(gw.URL, ps.Name).Set(float64(fr.TTFB.Milliseconds()))
 	}
-	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
-	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		t.errors.Inc()
-		return fmt.Errorf("failed to fetch from gateway: %w", err)
+		t.errors.WithLabelValues(gw.URL, ps.Name).Inc()
+		return res, task.Errorf(task.KindNetwork, "failed to fetch from gateway: %w", err)
 	}
-	respb, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		t.errors.Inc()
-		return fmt.Errorf("failed to downlaod content: %w", err)
-	}
-	total_time := time.Since(start).Milliseconds()
-	download_time := time.Since(firstbyte_time).Seconds()
-	log.Infow("finished download", "ms", total_time)
-	t.fetch_time.Observe(float64(total_time))
-	downloadBytesPerSecond := float64(t.size) / download_time
-	common_fetch_speed.Set(downloadBytesPerSecond)
+	log.Infow("finished download", "ms", fr.Total.Milliseconds())
+	t.fetch_time.WithLabelValues(gw.URL, ps.Name).Observe(float64(fr.Total.Milliseconds()))
+	common_fetch_speed.WithLabelValues(gw.URL, ps.Name).Set(fr.BytesPerSecond())
 
 	log.Info("checking result")
+	if err := checkStatus(fr, http.StatusOK); err != nil {
+		t.fails.WithLabelValues(gw.URL, ps.Name).Inc()
+		return res, res.Fail(fmt.Errorf("failed to fetch pinned content from gateway: %s: %w", url, err))
+	}
 	// compare response with what we sent
-	if !reflect.DeepEqual(respb, randb) {
-		t.fails.Inc()
-		return fmt.Errorf("expected response from gateway to match generated content: %s", url)
+	if err := checkContent(res, v); err != nil {
+		t.fails.WithLabelValues(gw.URL, ps.Name).Inc()
+		return res, res.Fail(fmt.Errorf("expected response from gateway to match generated content: %s: %w", url, err))
 	}
 
-	return nil
+	return res, nil
+}
+
+// observeStages records the time it took the pin request to reach status,
+// given that it had already gone through the first reached pinStages.
+// Stages the service went through between two polls are recorded with the
+// same time, and a status that isn't one of pinStages doesn't change
+// anything. It returns how many stages have been reached.
+func (t *RandomPinningBench) observeStages(res *task.Result, gw gateway.Gateway, ps *provider.Provider, status pinning.Status, reached int, elapsed time.Duration) int {
+	for i := reached; i < len(pinStages); i++ {
+		if pinStages[i] != status {
+			continue
+		}
+		for ; reached <= i; reached++ {
+			t.stage_time[pinStages[reached]].WithLabelValues(gw.URL, ps.Name).Observe(elapsed.Seconds())
+			res.AddPhase(pinStages[reached].String(), elapsed)
+		}
+		break
+	}
+	return reached
 }
 
 func (t *RandomPinningBench) Registration() *task.Registration {
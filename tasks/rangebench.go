@@ -0,0 +1,244 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	shell "github.com/ipfs/go-ipfs-api"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/fetch"
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
+	"github.com/coryschwartz/gateway-monitor/pkg/verify"
+)
+
+// rangeLength is the length of each requested byte range.
+const rangeLength = 256 * kiB
+
+// byteRange is a range of a file, as requested in a Range header.
+type byteRange struct {
+	offset int64
+	length int64
+}
+
+func (r byteRange) String() string {
+	return fmt.Sprintf("%d-%d", r.offset, r.offset+r.length-1)
+}
+
+// RangeBench adds a large file to the local node and requests byte ranges
+// of it from the gateway, the way video players and resumed downloads do.
+type RangeBench struct {
+	reg        *task.Registration
+	size       int
+	start_time *prometheus.HistogramVec
+	fetch_time *prometheus.HistogramVec
+	fails      *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+}
+
+func NewRangeBench(schedule string, size int) *RangeBench {
+	start_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "range",
+			Name:      fmt.Sprintf("%d_latency", size),
+		},
+		[]string{"gateway", "range"},
+	)
+	fetch_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "range",
+			Name:      fmt.Sprintf("%d_fetch_time", size),
+		},
+		[]string{"gateway", "range"},
+	)
+	fails := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "range",
+			Name:      "fail_count",
+		},
+		[]string{"gateway"},
+	)
+	errors := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "range",
+			Name:      "error_count",
+		},
+		[]string{"gateway"},
+	)
+	reg := task.Registration{
+		Name:     fmt.Sprintf("range_%d", size),
+		Schedule: schedule,
+		Group:    BandwidthGroup,
+		Collectors: []prometheus.Collector{
+			start_time,
+			fetch_time,
+			fails,
+			errors,
+		},
+	}
+	return &RangeBench{
+		reg:        &reg,
+		size:       size,
+		start_time: start_time,
+		fetch_time: fetch_time,
+		fails:      fails,
+		errors:     errors,
+	}
+}
+
+func (t *RangeBench) Run(ctx context.Context, sh *shell.Shell, ps *provider.Provider, gw gateway.Gateway) (*task.Result, error) {
+	res := task.NewResult()
+
+	payload, err := NewPayload(t.size, ShapeFile)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, err
+	}
+	log.Infow("generating random data", "bytes", t.size, "seed", payload.Seed)
+	res.Set("seed", strconv.FormatInt(payload.Seed, 10))
+	file := payload.Files()[0]
+
+	// add to local ipfs
+	root, unpin, err := addPayload(res, sh, payload, t.errors.WithLabelValues(gw.URL))
+	if err != nil {
+		return res, err
+	}
+	defer unpin()
+	cidstr := root.String()
+
+	// the ranges are at most a quarter of the file, so that start,
+	// middle and end don't overlap and can be requested together.
+	size := int64(t.size)
+	length := int64(rangeLength)
+	if size < 4*length {
+		length = size / 4
+	}
+	if length < 1 {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, fmt.Errorf("file of %d bytes is too small for range requests", size)
+	}
+	start := byteRange{0, length}
+	middle := byteRange{size/2 - length/2, length}
+	end := byteRange{size - length, length}
+	checks := []struct {
+		name   string
+		header string
+		ranges []byteRange
+	}{
+		// the first request is the one that has to find the content,
+		// so the others measure seeking within it.
+		{"start", "bytes=" + start.String(), []byteRange{start}},
+		{"middle", "bytes=" + middle.String(), []byteRange{middle}},
+		{"end", fmt.Sprintf("bytes=-%d", length), []byteRange{end}},
+		{"multi", fmt.Sprintf("bytes=%s,%s", start, middle), []byteRange{start, middle}},
+	}
+
+	url := gw.Path("/ipfs/" + cidstr)
+	res.Set("url", url)
+	for i, c := range checks {
+		log.Infow("requesting range from gateway", "url", url, "range", c.header)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			t.errors.WithLabelValues(gw.URL).Inc()
+			return res, err
+		}
+		req.Header.Set("Range", c.header)
+		var buf bytes.Buffer
+		fr, err := fetch.Default.Do(req, &buf)
+		if i == 0 {
+			recordFetch(res, fr)
+		} else if fr != nil {
+			res.Bytes += fr.Size
+		}
+		if err != nil {
+			t.errors.WithLabelValues(gw.URL).Inc()
+			return res, task.Errorf(task.KindNetwork, "failed to fetch range %s from gateway: %w", c.header, err)
+		}
+		log.Infow("received range", "range", c.name, "ttfb_ms", fr.TTFB.Milliseconds(), "ms", fr.Total.Milliseconds())
+		t.start_time.WithLabelValues(gw.URL, c.name).Observe(float64(fr.TTFB.Milliseconds()))
+		t.fetch_time.WithLabelValues(gw.URL, c.name).Observe(float64(fr.Total.Milliseconds()))
+		res.AddPhase(c.name+"_ttfb", fr.TTFB)
+
+		if fr.StatusCode != http.StatusPartialContent {
+			t.fails.WithLabelValues(gw.URL).Inc()
+			return res, res.Fail(task.Errorf(task.KindHTTPStatus, "expected status 206 for range %s, got %d: %s", c.header, fr.StatusCode, url))
+		}
+		if len(c.ranges) == 1 {
+			err = checkRange(res, file, c.ranges[0], fr.Header.Get("Content-Range"), &buf)
+		} else {
+			err = checkMultiRange(res, file, c.ranges, fr.Header.Get("Content-Type"), &buf)
+		}
+		if err != nil {
+			t.fails.WithLabelValues(gw.URL).Inc()
+			return res, res.Fail(fmt.Errorf("bad response for range %s: %s: %w", c.header, url, err))
+		}
+	}
+
+	return res, nil
+}
+
+func (t *RangeBench) Registration() *task.Registration {
+	return t.reg
+}
+
+// checkRange checks one range of a partial content response.
+func checkRange(res *task.Result, f PayloadFile, br byteRange, contentRange string, body io.Reader) error {
+	want := fmt.Sprintf("bytes %s/%d", br, f.Size)
+	if contentRange != want && contentRange != fmt.Sprintf("bytes %s/*", br) {
+		return task.Errorf(task.KindHTTPStatus, "expected Content-Range %q, got %q", want, contentRange)
+	}
+	r, err := f.Range(br.offset, br.length)
+	if err != nil {
+		return err
+	}
+	v := verify.NewReaderVerifier(r, br.length)
+	if _, err := io.Copy(v, body); err != nil {
+		return err
+	}
+	if err := checkContent(res, v); err != nil {
+		// report where in the file, not the range, the content differed
+		var mismatch *verify.MismatchError
+		if errors.As(err, &mismatch) {
+			res.Set("mismatch_offset", strconv.FormatInt(br.offset+mismatch.Offset, 10))
+		}
+		return fmt.Errorf("range doesn't match generated content: %w", err)
+	}
+	return nil
+}
+
+// checkMultiRange checks a multipart/byteranges response, which must
+// contain the ranges in the order they were requested.
+func checkMultiRange(res *task.Result, f PayloadFile, brs []byteRange, contentType string, body io.Reader) error {
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mt != "multipart/byteranges" {
+		return task.Errorf(task.KindHTTPStatus, "expected multipart/byteranges content type, got %q", contentType)
+	}
+	mr := multipart.NewReader(body, params["boundary"])
+	for i, br := range brs {
+		part, err := mr.NextPart()
+		if err != nil {
+			return task.Errorf(task.KindContentMismatch, "failed to read part %d: %w", i, err)
+		}
+		if err := checkRange(res, f, br, part.Header.Get("Content-Range"), part); err != nil {
+			return fmt.Errorf("part %d: %w", i, err)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		return task.Errorf(task.KindContentMismatch, "expected %d parts", len(brs))
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/ipfs/go-cid"
+	shell "github.com/ipfs/go-ipfs-api"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/fetch"
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
+)
+
+// rawMaxBlocks is how many blocks RawBlockCheck requests per run,
+// the root included.
+const rawMaxBlocks = 8
+
+// RawBlockCheck adds content to the local node and requests individual
+// blocks of it from the gateway with application/vnd.ipld.raw, checking
+// that each one hashes to its CID. Unlike RandomLocalBench this measures
+// block availability without the cost of UnixFS reassembly.
+type RawBlockCheck struct {
+	reg        *task.Registration
+	size       int
+	start_time *prometheus.HistogramVec
+	fetch_time *prometheus.HistogramVec
+	fails      *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+}
+
+func NewRawBlockCheck(schedule string, size int) *RawBlockCheck {
+	start_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "raw_block",
+			Name:      fmt.Sprintf("%d_latency", size),
+		},
+		[]string{"gateway", "block"},
+	)
+	fetch_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "raw_block",
+			Name:      fmt.Sprintf("%d_fetch_time", size),
+		},
+		[]string{"gateway", "block"},
+	)
+	fails := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "raw_block",
+			Name:      "fail_count",
+		},
+		[]string{"gateway"},
+	)
+	errors := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "raw_block",
+			Name:      "error_count",
+		},
+		[]string{"gateway"},
+	)
+	reg := task.Registration{
+		Name:     fmt.Sprintf("raw_block_%d", size),
+		Schedule: schedule,
+		Group:    BandwidthGroup,
+		Collectors: []prometheus.Collector{
+			start_time,
+			fetch_time,
+			fails,
+			errors,
+		},
+	}
+	return &RawBlockCheck{
+		reg:        &reg,
+		size:       size,
+		start_time: start_time,
+		fetch_time: fetch_time,
+		fails:      fails,
+		errors:     errors,
+	}
+}
+
+func (t *RawBlockCheck) Run(ctx context.Context, sh *shell.Shell, ps *provider.Provider, gw gateway.Gateway) (*task.Result, error) {
+	res := task.NewResult()
+
+	payload, err := NewPayload(t.size, ShapeFile)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, err
+	}
+	log.Infow("generating random data", "bytes", t.size, "seed", payload.Seed)
+	res.Set("seed", strconv.FormatInt(payload.Seed, 10))
+
+	// add to local ipfs
+	root, unpin, err := addPayload(res, sh, payload, t.errors.WithLabelValues(gw.URL))
+	if err != nil {
+		return res, err
+	}
+	defer unpin()
+	cidstr := root.String()
+
+	// pick the root and a sample of the other blocks
+	blocks, err := dagBlocks(sh, cidstr)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, task.Errorf(task.KindLocalNode, "failed to list blocks on local IPFS node: %w", err)
+	}
+	leaves := blocks[1:]
+	rand.Shuffle(len(leaves), func(i, j int) {
+		leaves[i], leaves[j] = leaves[j], leaves[i]
+	})
+	if len(blocks) > rawMaxBlocks {
+		blocks = blocks[:rawMaxBlocks]
+	}
+	res.Set("blocks", strconv.Itoa(len(blocks)))
+
+	var total time.Duration
+	for i, b := range blocks {
+		kind := "leaf"
+		if i == 0 {
+			kind = "root"
+		}
+		c, err := cid.Decode(b)
+		if err != nil {
+			t.errors.WithLabelValues(gw.URL).Inc()
+			return res, task.Errorf(task.KindLocalNode, "failed to decode cid after it was returned from IPFS: %w", err)
+		}
+
+		url := gw.Path("/ipfs/" + b + "?format=raw")
+		log.Infow("fetching block from gateway", "url", url)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			t.errors.WithLabelValues(gw.URL).Inc()
+			return res, err
+		}
+		req.Header.Set("Accept", "application/vnd.ipld.raw")
+		var buf bytes.Buffer
+		fr, err := fetch.Default.Do(req, &buf)
+		if i == 0 {
+			res.Set("url", url)
+			recordFetch(res, fr)
+		} else if fr != nil {
+			res.Bytes += fr.Size
+		}
+		if err != nil {
+			t.errors.WithLabelValues(gw.URL).Inc()
+			return res, task.Errorf(task.KindNetwork, "failed to fetch block from gateway: %w", err)
+		}
+		t.start_time.WithLabelValues(gw.URL, kind).Observe(float64(fr.TTFB.Milliseconds()))
+		t.fetch_time.WithLabelValues(gw.URL, kind).Observe(float64(fr.Total.Milliseconds()))
+		total += fr.Total
+
+		if fr.StatusCode != http.StatusOK {
+			t.fails.WithLabelValues(gw.URL).Inc()
+			return res, res.Fail(task.Errorf(task.KindHTTPStatus, "expected status 200 for raw block, got %d: %s", fr.StatusCode, url))
+		}
+		if ct := fr.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/vnd.ipld.raw") {
+			t.fails.WithLabelValues(gw.URL).Inc()
+			return res, res.Fail(task.Errorf(task.KindHTTPStatus, "expected raw block content type, got %q: %s", ct, url))
+		}
+		sum, err := c.Prefix().Sum(buf.Bytes())
+		if err != nil {
+			t.errors.WithLabelValues(gw.URL).Inc()
+			return res, fmt.Errorf("failed to hash block %s: %w", b, err)
+		}
+		if !sum.Equals(c) {
+			t.fails.WithLabelValues(gw.URL).Inc()
+			return res, res.Fail(task.Errorf(task.KindContentMismatch, "raw block from gateway does not match its hash (got %s): %s", sum, url))
+		}
+	}
+	log.Infow("finished fetching blocks", "ms", total.Milliseconds(), "blocks", len(blocks))
+	res.AddPhase("fetch_blocks", total)
+
+	return res, nil
+}
+
+func (t *RawBlockCheck) Registration() *task.Registration {
+	return t.reg
+}
@@ -0,0 +1,275 @@
+package tasks
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/config"
+	"github.com/coryschwartz/gateway-monitor/pkg/routing"
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
+)
+
+// Builder creates a task from its config entry.
+type Builder func(tc config.Task) (task.Task, error)
+
+// Registry maps the task types that may be used in a config file
+// to the builders that create them.
+var Registry = map[string]Builder{
+	"random_local": func(tc config.Task) (task.Task, error) {
+		var p struct {
+			Size  config.Size `yaml:"size"`
+			Shape string      `yaml:"shape"`
+		}
+		if err := tc.DecodeParams(&p); err != nil {
+			return nil, err
+		}
+		if p.Size <= 0 {
+			return nil, fmt.Errorf("size must be positive")
+		}
+		shape, err := ParseShape(p.Shape)
+		if err != nil {
+			return nil, err
+		}
+		return NewRandomLocalShapeBench(tc.Schedule, int(p.Size), shape), nil
+	},
+	"ipns": func(tc config.Task) (task.Task, error) {
+		var p struct {
+			Size config.Size `yaml:"size"`
+		}
+		if err := tc.DecodeParams(&p); err != nil {
+			return nil, err
+		}
+		if p.Size <= 0 {
+			return nil, fmt.Errorf("size must be positive")
+		}
+		return NewIpnsBench(tc.Schedule, int(p.Size)), nil
+	},
+	"known_good": func(tc config.Task) (task.Task, error) {
+		var p struct {
+			Checks map[string]string `yaml:"checks"`
+		}
+		if err := tc.DecodeParams(&p); err != nil {
+			return nil, err
+		}
+		if len(p.Checks) == 0 {
+			return nil, fmt.Errorf("at least one check is required")
+		}
+		checks := make(map[string][]byte, len(p.Checks))
+		for path, value := range p.Checks {
+			checks[path] = []byte(value)
+		}
+		return NewKnownGoodCheck(tc.Schedule, checks), nil
+	},
+	"non_exist": func(tc config.Task) (task.Task, error) {
+		return NewNonExistCheck(tc.Schedule), nil
+	},
+	"random_pinning": func(tc config.Task) (task.Task, error) {
+		var p struct {
+			Size config.Size `yaml:"size"`
+		}
+		if err := tc.DecodeParams(&p); err != nil {
+			return nil, err
+		}
+		if p.Size <= 0 {
+			return nil, fmt.Errorf("size must be positive")
+		}
+		return NewRandomPinningBench(tc.Schedule, int(p.Size)), nil
+	},
+	"pinning_conformance": func(tc config.Task) (task.Task, error) {
+		return NewPinningConformanceCheck(tc.Schedule), nil
+	},
+	"car": func(tc config.Task) (task.Task, error) {
+		var p struct {
+			Size config.Size `yaml:"size"`
+		}
+		if err := tc.DecodeParams(&p); err != nil {
+			return nil, err
+		}
+		if p.Size <= 0 {
+			return nil, fmt.Errorf("size must be positive")
+		}
+		return NewCarCheck(tc.Schedule, int(p.Size)), nil
+	},
+	"raw_block": func(tc config.Task) (task.Task, error) {
+		var p struct {
+			Size config.Size `yaml:"size"`
+		}
+		if err := tc.DecodeParams(&p); err != nil {
+			return nil, err
+		}
+		if p.Size <= 0 {
+			return nil, fmt.Errorf("size must be positive")
+		}
+		return NewRawBlockCheck(tc.Schedule, int(p.Size)), nil
+	},
+	"range": func(tc config.Task) (task.Task, error) {
+		var p struct {
+			Size config.Size `yaml:"size"`
+		}
+		if err := tc.DecodeParams(&p); err != nil {
+			return nil, err
+		}
+		if p.Size < 4 {
+			return nil, fmt.Errorf("size must be at least 4 bytes")
+		}
+		return NewRangeBench(tc.Schedule, int(p.Size)), nil
+	},
+	"directory": func(tc config.Task) (task.Task, error) {
+		var p struct {
+			Entries int `yaml:"entries"`
+		}
+		if err := tc.DecodeParams(&p); err != nil {
+			return nil, err
+		}
+		if p.Entries < 0 {
+			return nil, fmt.Errorf("entries must not be negative")
+		}
+		return NewDirectoryCheck(tc.Schedule, p.Entries), nil
+	},
+	"sharded_dir": func(tc config.Task) (task.Task, error) {
+		var p struct {
+			Entries int `yaml:"entries"`
+		}
+		if err := tc.DecodeParams(&p); err != nil {
+			return nil, err
+		}
+		if p.Entries < 0 {
+			return nil, fmt.Errorf("entries must not be negative")
+		}
+		return NewShardedDirBench(tc.Schedule, p.Entries), nil
+	},
+	"subdomain": func(tc config.Task) (task.Task, error) {
+		p := struct {
+			DNSLink string `yaml:"dnslink"`
+		}{
+			DNSLink: DefaultDNSLinkDomain,
+		}
+		if err := tc.DecodeParams(&p); err != nil {
+			return nil, err
+		}
+		return NewSubdomainCheck(tc.Schedule, p.DNSLink), nil
+	},
+	"dnslink": func(tc config.Task) (task.Task, error) {
+		var p struct {
+			Domains    []string `yaml:"domains"`
+			HostHeader bool     `yaml:"host_header"`
+		}
+		if err := tc.DecodeParams(&p); err != nil {
+			return nil, err
+		}
+		if len(p.Domains) == 0 {
+			return nil, fmt.Errorf("at least one domain is required")
+		}
+		modes := []string{DNSLinkPath}
+		if p.HostHeader {
+			modes = append(modes, DNSLinkHost)
+		}
+		return NewDNSLinkCheck(tc.Schedule, p.Domains, modes...), nil
+	},
+	"ipns_update": func(tc config.Task) (task.Task, error) {
+		p := struct {
+			Key string        `yaml:"key"`
+			TTL time.Duration `yaml:"ttl"`
+		}{
+			Key: DefaultIpnsUpdateKey,
+			TTL: DefaultIpnsUpdateTTL,
+		}
+		if err := tc.DecodeParams(&p); err != nil {
+			return nil, err
+		}
+		if p.Key == "" {
+			return nil, fmt.Errorf("key must not be empty")
+		}
+		return NewIpnsUpdateBench(tc.Schedule, p.Key, p.TTL), nil
+	},
+	"provider_record": func(tc config.Task) (task.Task, error) {
+		p := struct {
+			Size      config.Size `yaml:"size"`
+			Delegated string      `yaml:"delegated"`
+		}{
+			Delegated: DefaultRoutingEndpoint,
+		}
+		if err := tc.DecodeParams(&p); err != nil {
+			return nil, err
+		}
+		if p.Size <= 0 {
+			return nil, fmt.Errorf("size must be positive")
+		}
+		return NewProviderRecordBench(tc.Schedule, int(p.Size), p.Delegated), nil
+	},
+	"routing": func(tc config.Task) (task.Task, error) {
+		p := struct {
+			Endpoint string   `yaml:"endpoint"`
+			Peers    []string `yaml:"peers"`
+			IPNS     []string `yaml:"ipns"`
+		}{
+			Endpoint: DefaultRoutingEndpoint,
+		}
+		if err := tc.DecodeParams(&p); err != nil {
+			return nil, err
+		}
+		for _, id := range append(p.Peers, p.IPNS...) {
+			if _, err := routing.ParsePeerID(id); err != nil {
+				return nil, fmt.Errorf("%s: %w", id, err)
+			}
+		}
+		return NewRoutingCheck(tc.Schedule, p.Endpoint, p.Peers, p.IPNS), nil
+	},
+	"cache": func(tc config.Task) (task.Task, error) {
+		p := struct {
+			Size    config.Size `yaml:"size"`
+			Fetches int         `yaml:"fetches"`
+		}{
+			Fetches: DefaultCacheFetches,
+		}
+		if err := tc.DecodeParams(&p); err != nil {
+			return nil, err
+		}
+		if p.Size <= 0 {
+			return nil, fmt.Errorf("size must be positive")
+		}
+		if p.Fetches < 2 {
+			return nil, fmt.Errorf("fetches must be at least 2, to compare cold and warm fetches")
+		}
+		return NewCacheCheck(tc.Schedule, int(p.Size), p.Fetches), nil
+	},
+	"noop": func(tc config.Task) (task.Task, error) {
+		var p struct {
+			Count int `yaml:"count"`
+		}
+		if err := tc.DecodeParams(&p); err != nil {
+			return nil, err
+		}
+		return NewNoopTask(tc.Schedule, p.Count), nil
+	},
+}
+
+// Build creates the task described by a config entry.
+func Build(tc config.Task) (task.Task, error) {
+	b, ok := Registry[tc.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown task type %q", tc.Type)
+	}
+	t, err := b(tc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", tc.Type, err)
+	}
+	reg := t.Registration()
+	reg.Gateways = config.Gateways(tc.Gateways)
+	if tc.Name != "" {
+		reg.Name = tc.Name
+	}
+	if tc.Group != "" {
+		reg.Group = tc.Group
+	}
+	reg.Timeout = tc.Timeout
+	reg.Retries = tc.Retries
+	if tc.Backoff != nil {
+		reg.Backoff = &task.Backoff{
+			Initial:    tc.Backoff.Initial,
+			Max:        tc.Backoff.Max,
+			Multiplier: tc.Backoff.Multiplier,
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,246 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	shell "github.com/ipfs/go-ipfs-api"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
+	"github.com/coryschwartz/gateway-monitor/pkg/routing"
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
+)
+
+// Formats of the records responses, the format label of the metrics.
+const (
+	routingFormatJSON   = "json"
+	routingFormatNDJSON = "ndjson"
+	routingFormatIPNS   = "ipns_record"
+)
+
+// RoutingCheck checks a Delegated Routing HTTP API endpoint: it looks up
+// the providers of freshly added content, peer records and IPNS records,
+// and checks that the responses follow the spec.
+type RoutingCheck struct {
+	reg          *task.Registration
+	endpoint     string
+	peers        []string
+	names        []string
+	request_time *prometheus.HistogramVec
+	records      *prometheus.HistogramVec
+	invalid      *prometheus.CounterVec
+	fails        *prometheus.CounterVec
+	errors       *prometheus.CounterVec
+}
+
+// NewRoutingCheck queries endpoint, once per run rather than once per
+// gateway, or each gateway itself if it is empty. Metrics are labelled
+// with the endpoint queried rather than the gateway.
+// The local node's peer ID is looked up if no peers are given. IPNS
+// records are only looked up for the given names.
+func NewRoutingCheck(schedule string, endpoint string, peers []string, names []string) *RoutingCheck {
+	request_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "routing",
+			Name:      "request_seconds",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+		},
+		[]string{"endpoint", "kind", "format"},
+	)
+	records := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "routing",
+			Name:      "records",
+			Buckets:   []float64{0, 1, 2, 5, 10, 20, 50, 100},
+		},
+		[]string{"endpoint", "kind"},
+	)
+	invalid := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "routing",
+			Name:      "invalid_count",
+		},
+		[]string{"endpoint", "kind"},
+	)
+	fails := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "routing",
+			Name:      "fail_count",
+		},
+		[]string{"endpoint"},
+	)
+	errors := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "routing",
+			Name:      "error_count",
+		},
+		[]string{"endpoint"},
+	)
+	reg := task.Registration{
+		Name:      "routing",
+		Schedule:  schedule,
+		NoGateway: endpoint != "",
+		Collectors: []prometheus.Collector{
+			request_time,
+			records,
+			invalid,
+			fails,
+			errors,
+		},
+	}
+	return &RoutingCheck{
+		reg:          &reg,
+		endpoint:     endpoint,
+		peers:        peers,
+		names:        names,
+		request_time: request_time,
+		records:      records,
+		invalid:      invalid,
+		fails:        fails,
+		errors:       errors,
+	}
+}
+
+func (t *RoutingCheck) Run(ctx context.Context, sh *shell.Shell, ps *provider.Provider, gw gateway.Gateway) (*task.Result, error) {
+	res := task.NewResult()
+
+	endpoint := t.endpoint
+	if endpoint == "" {
+		endpoint = gw.URL
+	}
+	c := routing.New(endpoint)
+	res.Set("endpoint", c.URL)
+
+	// every lookup is done even if one fails
+	probs := newProblems(t.errors.WithLabelValues(c.URL), t.fails.WithLabelValues(c.URL))
+	// check classifies the error of a request: responses that don't
+	// follow the spec are failures of the endpoint, not being able to
+	// ask it is an error.
+	check := func(kind, key string, err error) {
+		var (
+			statusErr *routing.StatusError
+			schemaErr *routing.SchemaError
+		)
+		switch {
+		case errors.As(err, &statusErr):
+			probs.addFail(task.KindHTTPStatus, "%s/%s: %s", kind, key, err)
+		case errors.As(err, &schemaErr):
+			t.invalid.WithLabelValues(c.URL, kind).Inc()
+			probs.addFail(task.KindContentMismatch, "%s/%s: %s", kind, key, err)
+		default:
+			probs.addErr(task.WrapError(task.KindNetwork, err), "%s/%s: %s", kind, key, err)
+		}
+	}
+	// lookup requests the records of key in both formats and validates
+	// them, returning those of the JSON response.
+	lookup := func(kind, key string) []routing.Record {
+		var out []routing.Record
+		for _, f := range []struct{ name, accept string }{
+			{routingFormatJSON, routing.JSON},
+			{routingFormatNDJSON, routing.NDJSON},
+		} {
+			start := time.Now()
+			recs, err := c.Records(ctx, kind, key, f.accept)
+			elapsed := time.Since(start)
+			if err != nil {
+				check(kind, key, err)
+				continue
+			}
+			log.Infow("routing records received", "endpoint", c.URL, "kind", kind, "key", key, "format", f.name, "records", len(recs), "ms", elapsed.Milliseconds())
+			res.AddPhase(kind+"_"+f.name, elapsed)
+			t.request_time.WithLabelValues(c.URL, kind, f.name).Observe(elapsed.Seconds())
+			t.records.WithLabelValues(c.URL, kind).Observe(float64(len(recs)))
+			for _, r := range recs {
+				if err := r.Validate(); err != nil {
+					check(kind, key, err)
+				}
+			}
+			if f.accept == routing.JSON {
+				out = recs
+				res.Set(kind+"_records", strconv.Itoa(len(recs)))
+			}
+		}
+		return out
+	}
+
+	peers := t.peers
+	if len(peers) == 0 {
+		self, err := sh.ID()
+		if err != nil {
+			t.errors.WithLabelValues(c.URL).Inc()
+			return res, task.Errorf(task.KindLocalNode, "failed to get the peer id of the local node: %w", err)
+		}
+		peers = []string{self.ID}
+	}
+
+	// providers of content the endpoint can't have cached
+	payload, err := NewPayload(kiB, ShapeFile)
+	if err != nil {
+		t.errors.WithLabelValues(c.URL).Inc()
+		return res, err
+	}
+	res.Set("seed", strconv.FormatInt(payload.Seed, 10))
+	root, unpin, err := addPayload(res, sh, payload, t.errors.WithLabelValues(c.URL))
+	if err != nil {
+		return res, err
+	}
+	defer unpin()
+	cidstr := root.String()
+	lookup(routing.Providers, cidstr)
+
+	for _, p := range peers {
+		m, err := routing.ParsePeerID(p)
+		if err != nil {
+			probs.addErr(err, "%s: %s", p, err)
+			continue
+		}
+		key, _ := routing.PeerCID(p)
+		for _, r := range lookup(routing.Peers, key) {
+			if r.Schema != routing.SchemaPeer {
+				continue
+			}
+			// Validate checked that it parses
+			id, _ := routing.ParsePeerID(r.ID)
+			if !bytes.Equal(id, m) {
+				t.invalid.WithLabelValues(c.URL, routing.Peers).Inc()
+				probs.addFail(task.KindContentMismatch, "%s/%s: record of another peer %s", routing.Peers, key, r.ID)
+			}
+		}
+	}
+
+	for _, name := range t.names {
+		start := time.Now()
+		rec, err := c.GetIPNS(ctx, name)
+		elapsed := time.Since(start)
+		if err != nil {
+			check(routing.IPNS, name, err)
+			continue
+		}
+		log.Infow("IPNS record received", "endpoint", c.URL, "name", name, "bytes", len(rec), "ms", elapsed.Milliseconds())
+		res.AddPhase(routing.IPNS+"_"+routingFormatIPNS, elapsed)
+		t.request_time.WithLabelValues(c.URL, routing.IPNS, routingFormatIPNS).Observe(elapsed.Seconds())
+		found := 0
+		if rec != nil {
+			found = 1
+			res.Bytes += int64(len(rec))
+		}
+		t.records.WithLabelValues(c.URL, routing.IPNS).Observe(float64(found))
+	}
+
+	return res, probs.err(res, "failed to query routing endpoint", "bad routing responses")
+}
+
+func (t *RoutingCheck) Registration() *task.Registration {
+	return t.reg
+}
@@ -0,0 +1,225 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	shell "github.com/ipfs/go-ipfs-api"
+	files "github.com/ipfs/go-ipfs-files"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/fetch"
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
+)
+
+const (
+	// DefaultShardedEntries is the size of the directory of
+	// ShardedDirBench. IPFS nodes shard directories this large.
+	DefaultShardedEntries = 10000
+
+	// how many random entries are resolved per run
+	shardedProbes = 5
+)
+
+// ShardedDirBench adds a directory large enough to be HAMT-sharded to the
+// local node and measures how long the gateway takes to resolve random
+// entries of it and to render its listing.
+type ShardedDirBench struct {
+	reg          *task.Registration
+	entries      int
+	resolve_time *prometheus.HistogramVec
+	listing_time *prometheus.HistogramVec
+	fails        *prometheus.CounterVec
+	errors       *prometheus.CounterVec
+}
+
+func NewShardedDirBench(schedule string, entries int) *ShardedDirBench {
+	if entries <= 0 {
+		entries = DefaultShardedEntries
+	}
+	resolve_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "sharded_dir",
+			Name:      fmt.Sprintf("%d_resolve_time", entries),
+		},
+		[]string{"gateway"},
+	)
+	listing_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "sharded_dir",
+			Name:      fmt.Sprintf("%d_listing_time", entries),
+		},
+		[]string{"gateway", "status"},
+	)
+	fails := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "sharded_dir",
+			Name:      "fail_count",
+		},
+		[]string{"gateway"},
+	)
+	errors := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "sharded_dir",
+			Name:      "error_count",
+		},
+		[]string{"gateway"},
+	)
+	reg := task.Registration{
+		Name:     fmt.Sprintf("sharded_dir_%d", entries),
+		Schedule: schedule,
+		Group:    BandwidthGroup,
+		Collectors: []prometheus.Collector{
+			resolve_time,
+			listing_time,
+			fails,
+			errors,
+		},
+	}
+	return &ShardedDirBench{
+		reg:          &reg,
+		entries:      entries,
+		resolve_time: resolve_time,
+		listing_time: listing_time,
+		fails:        fails,
+		errors:       errors,
+	}
+}
+
+func (t *ShardedDirBench) Run(ctx context.Context, sh *shell.Shell, ps *provider.Provider, gw gateway.Gateway) (*task.Result, error) {
+	res := task.NewResult()
+
+	// the entries contain the seed, so every run adds a new directory
+	payload, err := NewPayload(0, ShapeFile)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, err
+	}
+	log.Infow("generating sharded directory", "entries", t.entries, "seed", payload.Seed)
+	res.Set("seed", strconv.FormatInt(payload.Seed, 10))
+	res.Set("entries", strconv.Itoa(t.entries))
+	entry := func(i int) (string, []byte) {
+		return fmt.Sprintf("entry-%06d", i), []byte(fmt.Sprintf("%d %d\n", payload.Seed, i))
+	}
+	fls := make(map[string]files.Node, t.entries)
+	for i := 0; i < t.entries; i++ {
+		name, content := entry(i)
+		fls[name] = files.NewBytesFile(content)
+	}
+
+	// add to local ipfs
+	log.Info("writing directory to local IPFS node")
+	add_start := time.Now()
+	cidstr, err := addDirectory(ctx, sh, newDirectory(fls))
+	res.AddPhase("add", time.Since(add_start))
+	res.CID = cidstr
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, task.Errorf(task.KindLocalNode, "failed to write to IPFS: %w", err)
+	}
+	defer func() {
+		log.Info("cleaning up IPFS node")
+		err := sh.Unpin(cidstr)
+		if err != nil {
+			log.Warnw("failed to clean unpin cid.", "cid", cidstr)
+			t.errors.WithLabelValues(gw.URL).Inc()
+		}
+	}()
+
+	// the local node only shards directories above a size threshold,
+	// and a plain directory would measure something else.
+	block, err := sh.BlockGet(cidstr)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, task.Errorf(task.KindLocalNode, "failed to get the directory root from the local IPFS node: %w", err)
+	}
+	typ, err := unixfsType(block)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, task.Errorf(task.KindLocalNode, "failed to decode the directory root: %w", err)
+	}
+	if typ != unixfsHAMTShard {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, task.Errorf(task.KindLocalNode, "the local IPFS node didn't shard a directory of %d entries, use more entries", t.entries)
+	}
+
+	// resolve random entries
+	rnd := mrand.New(mrand.NewSource(payload.Seed))
+	var total time.Duration
+	for i := 0; i < shardedProbes; i++ {
+		name, content := entry(rnd.Intn(t.entries))
+		url := gw.Path("/ipfs/" + cidstr + "/" + name)
+		log.Infow("fetching entry from gateway", "url", url)
+		var buf bytes.Buffer
+		fr, err := fetch.Get(ctx, url, &buf)
+		if i == 0 {
+			// the first request is the one that has to find the content
+			res.Set("url", url)
+			recordFetch(res, fr)
+		} else if fr != nil {
+			res.Bytes += fr.Size
+		}
+		if err != nil {
+			t.errors.WithLabelValues(gw.URL).Inc()
+			return res, task.Errorf(task.KindNetwork, "failed to fetch from gateway: %w", err)
+		}
+		t.resolve_time.WithLabelValues(gw.URL).Observe(float64(fr.Total.Milliseconds()))
+		total += fr.Total
+
+		if err := checkStatus(fr, http.StatusOK); err != nil {
+			t.fails.WithLabelValues(gw.URL).Inc()
+			return res, res.Fail(fmt.Errorf("failed to resolve entry of sharded directory: %s: %w", url, err))
+		}
+		if !bytes.Equal(buf.Bytes(), content) {
+			t.fails.WithLabelValues(gw.URL).Inc()
+			return res, res.Fail(task.Errorf(task.KindContentMismatch, "expected response from gateway to match entry content: %s", url))
+		}
+	}
+	log.Infow("resolved entries", "ms", total.Milliseconds(), "probes", shardedProbes)
+	res.AddPhase("resolve", total)
+
+	// gateways may refuse to list large directories, which is fine,
+	// but it has to be quick about it either way.
+	url := gw.Path("/ipfs/" + cidstr + "/")
+	log.Infow("fetching listing from gateway", "url", url)
+	fr, err := fetch.Get(ctx, url, nil)
+	if fr != nil {
+		res.Bytes += fr.Size
+	}
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, task.Errorf(task.KindNetwork, "failed to fetch listing from gateway: %w", err)
+	}
+	log.Infow("received listing", "status", fr.StatusCode, "ms", fr.Total.Milliseconds())
+	t.listing_time.WithLabelValues(gw.URL, strconv.Itoa(fr.StatusCode)).Observe(float64(fr.Total.Milliseconds()))
+	res.AddPhase("listing", fr.Total)
+	res.Set("listing_status", strconv.Itoa(fr.StatusCode))
+	if fr.StatusCode == http.StatusOK {
+		if ct := fr.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.fails.WithLabelValues(gw.URL).Inc()
+			return res, res.Fail(task.Errorf(task.KindHTTPStatus, "expected an HTML listing, got %q: %s", ct, url))
+		}
+	} else if fr.StatusCode < 400 {
+		t.fails.WithLabelValues(gw.URL).Inc()
+		return res, res.Fail(task.Errorf(task.KindHTTPStatus, "expected a listing or an error, got status %d: %s", fr.StatusCode, url))
+	}
+
+	return res, nil
+}
+
+func (t *ShardedDirBench) Registration() *task.Registration {
+	return t.reg
+}
@@ -0,0 +1,212 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	shell "github.com/ipfs/go-ipfs-api"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/fetch"
+	"github.com/coryschwartz/gateway-monitor/pkg/gateway"
+	"github.com/coryschwartz/gateway-monitor/pkg/provider"
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
+	"github.com/coryschwartz/gateway-monitor/pkg/verify"
+)
+
+// DefaultDNSLinkDomain is a well known DNSLink name with dots and dashes,
+// both of which have to be encoded on subdomain gateways.
+const DefaultDNSLinkDomain = "en.wikipedia-on-ipfs.org"
+
+const subdomainSize = 64 * kiB
+
+// SubdomainCheck checks the behaviour specific to subdomain gateways:
+// that path requests are redirected to the subdomain of the CID (converted
+// to base32 CIDv1) or of the DNS-label encoded IPNS name, and that content
+// is served from there. Path gateways are skipped.
+type SubdomainCheck struct {
+	reg        *task.Registration
+	dnslink    string
+	start_time *prometheus.HistogramVec
+	fails      *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+}
+
+// NewSubdomainCheck creates the check. The redirect of dnslink is checked
+// as well, unless it is empty.
+func NewSubdomainCheck(schedule string, dnslink string) *SubdomainCheck {
+	start_time := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "subdomain",
+			Name:      "latency",
+		},
+		[]string{"gateway", "check"},
+	)
+	fails := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "subdomain",
+			Name:      "fail_count",
+		},
+		[]string{"gateway"},
+	)
+	errors := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gatewaymonitor_task",
+			Subsystem: "subdomain",
+			Name:      "error_count",
+		},
+		[]string{"gateway"},
+	)
+	reg := task.Registration{
+		Name:     "subdomain",
+		Schedule: schedule,
+		Collectors: []prometheus.Collector{
+			start_time,
+			fails,
+			errors,
+		},
+	}
+	return &SubdomainCheck{
+		reg:        &reg,
+		dnslink:    dnslink,
+		start_time: start_time,
+		fails:      fails,
+		errors:     errors,
+	}
+}
+
+func (t *SubdomainCheck) Run(ctx context.Context, sh *shell.Shell, ps *provider.Provider, gw gateway.Gateway) (*task.Result, error) {
+	if !gw.Subdomain {
+		log.Debugw("skipping path gateway", "gateway", gw)
+		return nil, nil
+	}
+	res := task.NewResult()
+
+	payload, err := NewPayload(subdomainSize, ShapeFile)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, err
+	}
+	log.Infow("generating random data", "bytes", subdomainSize, "seed", payload.Seed)
+	res.Set("seed", strconv.FormatInt(payload.Seed, 10))
+
+	// add to local ipfs. The node returns a CIDv0, which can't be
+	// used as a DNS label as it is case sensitive.
+	root, unpin, err := addPayload(res, sh, payload, t.errors.WithLabelValues(gw.URL))
+	if err != nil {
+		return res, err
+	}
+	defer unpin()
+	cidstr := root.String()
+
+	// a path request is redirected to the subdomain
+	path := "/ipfs/" + cidstr
+	want, err := gw.SubdomainURL(path)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, err
+	}
+	url := gw.URL + path
+	fr, err := t.fetch(ctx, res, gw, "redirect", url, fetch.NoRedirect, nil)
+	recordFetch(res, fr)
+	if err != nil {
+		return res, err
+	}
+	if err := checkRedirect(fr, want); err != nil {
+		t.fails.WithLabelValues(gw.URL).Inc()
+		return res, res.Fail(fmt.Errorf("expected path request to redirect to subdomain: %s: %w", url, err))
+	}
+
+	// which serves the content
+	v := verify.NewReaderVerifier(payload.Reader(), subdomainSize)
+	fr, err = t.fetch(ctx, res, gw, "content", want, fetch.Default, v)
+	if fr != nil {
+		res.Bytes += fr.Size
+	}
+	if err != nil {
+		return res, err
+	}
+	if err := checkStatus(fr, http.StatusOK); err != nil {
+		t.fails.WithLabelValues(gw.URL).Inc()
+		return res, res.Fail(fmt.Errorf("failed to fetch from subdomain: %s: %w", want, err))
+	}
+	if err := checkContent(res, v); err != nil {
+		t.fails.WithLabelValues(gw.URL).Inc()
+		return res, res.Fail(fmt.Errorf("expected response from gateway to match generated content: %s: %w", want, err))
+	}
+
+	if t.dnslink == "" {
+		return res, nil
+	}
+	// DNSLink names are inlined into a single label
+	path = "/ipns/" + t.dnslink
+	want, err = gw.SubdomainURL(path)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return res, err
+	}
+	url = gw.URL + path
+	fr, err = t.fetch(ctx, res, gw, "dnslink_redirect", url, fetch.NoRedirect, nil)
+	if err != nil {
+		return res, err
+	}
+	if err := checkRedirect(fr, want); err != nil {
+		t.fails.WithLabelValues(gw.URL).Inc()
+		return res, res.Fail(fmt.Errorf("expected DNSLink path request to redirect to subdomain: %s: %w", url, err))
+	}
+
+	return res, nil
+}
+
+// fetch makes one request of the check, recording its latency.
+func (t *SubdomainCheck) fetch(ctx context.Context, res *task.Result, gw gateway.Gateway, check, url string, f *fetch.Fetcher, v verify.Verifier) (*fetch.Response, error) {
+	log.Infow("fetching from gateway", "check", check, "url", url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return nil, err
+	}
+	fr, err := f.Do(req, v)
+	if err != nil {
+		t.errors.WithLabelValues(gw.URL).Inc()
+		return fr, task.Errorf(task.KindNetwork, "failed to fetch from gateway: %w", err)
+	}
+	t.start_time.WithLabelValues(gw.URL, check).Observe(float64(fr.TTFB.Milliseconds()))
+	res.AddPhase(check, fr.Total)
+	return fr, nil
+}
+
+func (t *SubdomainCheck) Registration() *task.Registration {
+	return t.reg
+}
+
+// checkRedirect checks that the response redirects to want. Only the host
+// and path are compared, as gateways behind a proxy may not know the scheme.
+func checkRedirect(fr *fetch.Response, want string) error {
+	switch fr.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return task.Errorf(task.KindHTTPStatus, "expected a redirect, got status %d", fr.StatusCode)
+	}
+	loc := fr.Header.Get("Location")
+	got, err := url.Parse(loc)
+	if err != nil {
+		return task.Errorf(task.KindHTTPStatus, "invalid Location %q: %w", loc, err)
+	}
+	w, err := url.Parse(want)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(got.Host, w.Host) || strings.TrimSuffix(got.Path, "/") != strings.TrimSuffix(w.Path, "/") {
+		return task.Errorf(task.KindHTTPStatus, "expected redirect to %s, got %q", want, loc)
+	}
+	return nil
+}
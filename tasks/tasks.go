@@ -22,6 +22,10 @@ const (
 	giB = 1024 * miB
 )
 
+// BandwidthGroup is the concurrency group of the benchmarks that move a lot
+// of data, so that they don't skew each other's results.
+const BandwidthGroup = "bandwidth"
+
 var (
 	log = logging.Logger("tasks")
 
@@ -36,16 +40,26 @@ var (
 		NewNonExistCheck("0 * * * *"),
 	}
 
-	common_fetch_speed = prometheus.NewGauge(
+	// Pinning tasks are run in addition to All when a pinning service is
+	// configured.
+	Pinning = []task.Task{
+		NewRandomPinningBench("0 * * * *", 16*miB),
+	}
+
+	common_fetch_speed = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "common",
 			Name:      "fetch_speed",
-		})
-	common_fetch_latency = prometheus.NewGauge(
+		},
+		[]string{"gateway", "provider"},
+	)
+	common_fetch_latency = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "gatewaymonitor_task",
 			Subsystem: "common",
 			Name:      "fetch_latency",
-		})
+		},
+		[]string{"gateway", "provider"},
+	)
 )
@@ -0,0 +1,77 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/coryschwartz/gateway-monitor/pkg/fetch"
+	"github.com/coryschwartz/gateway-monitor/pkg/task"
+	"github.com/coryschwartz/gateway-monitor/pkg/verify"
+)
+
+// checkContent verifies the content received from the gateway,
+// recording where it first differed from what was expected.
+func checkContent(res *task.Result, v verify.Verifier) error {
+	err := v.Verify()
+	var mismatch *verify.MismatchError
+	if errors.As(err, &mismatch) {
+		res.Set("mismatch_offset", strconv.FormatInt(mismatch.Offset, 10))
+	}
+	return task.WrapError(task.KindContentMismatch, err)
+}
+
+// checkStatus checks the status code of a gateway response.
+func checkStatus(fr *fetch.Response, code int) error {
+	if fr.StatusCode != code {
+		return task.Errorf(task.KindHTTPStatus, "expected status %d, got %d", code, fr.StatusCode)
+	}
+	return nil
+}
+
+// problems collects the errors and failures of a run that goes on checking
+// after one of them fails, counting them as they are added. The first
+// error or failure decides the kind of the run's error.
+type problems struct {
+	errs, fails       []string
+	errKind, failKind task.Kind
+	errors, failures  prometheus.Counter
+}
+
+func newProblems(errors, failures prometheus.Counter) *problems {
+	return &problems{errors: errors, failures: failures}
+}
+
+// addErr records that a check couldn't be done.
+func (p *problems) addErr(err error, format string, a ...interface{}) {
+	p.errors.Inc()
+	if p.errKind == "" {
+		p.errKind = task.KindOf(err)
+	}
+	p.errs = append(p.errs, fmt.Sprintf(format, a...))
+}
+
+// addFail records that a check failed.
+func (p *problems) addFail(kind task.Kind, format string, a ...interface{}) {
+	p.failures.Inc()
+	if p.failKind == "" {
+		p.failKind = kind
+	}
+	p.fails = append(p.fails, fmt.Sprintf(format, a...))
+}
+
+// err returns the error of the run: the errors prefixed with errMsg if
+// there were any, otherwise the failures prefixed with failMsg, which fail
+// the result.
+func (p *problems) err(res *task.Result, errMsg, failMsg string) error {
+	if len(p.errs) > 0 {
+		return task.Errorf(p.errKind, "%s: %s", errMsg, strings.Join(p.errs, "; "))
+	}
+	if len(p.fails) > 0 {
+		return res.Fail(task.Errorf(p.failKind, "%s: %s", failMsg, strings.Join(p.fails, "; ")))
+	}
+	return nil
+}